@@ -0,0 +1,88 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Every engine binary understands `<engine> bench-run <file>`: it aggregates the file once
+// and prints a Result as JSON on stdout. The bench command runs engines this way so each run
+// gets a fresh process, which is the only way to get a meaningful peak RSS.
+
+const runCommand = "bench-run"
+
+type Result struct {
+	Engine   string `json:"engine"`
+	Dataset  string `json:"dataset"`
+	Bytes    int64  `json:"bytes"`
+	Rows     int64  `json:"rows"`
+	ColdRead bool   `json:"coldRead"`
+
+	Wall       time.Duration `json:"wallNs"`
+	Mallocs    uint64        `json:"mallocs"`
+	TotalAlloc uint64        `json:"totalAlloc"`
+	NumGC      uint32        `json:"numGC"`
+	GCPause    time.Duration `json:"gcPauseNs"`
+	MaxRSS     int64         `json:"maxRSS"` // bytes
+}
+
+func (r Result) MBPerSec() float64 {
+	return float64(r.Bytes) / 1024 / 1024 / r.Wall.Seconds()
+}
+
+func (r Result) RowsPerSec() float64 {
+	return float64(r.Rows) / r.Wall.Seconds()
+}
+
+// InputFile returns the file Go benchmarks should read: $BENCH_FILE if set, def otherwise.
+func InputFile(def string) string {
+	if f := os.Getenv("BENCH_FILE"); f != "" {
+		return f
+	}
+	return def
+}
+
+// Requested reports whether the engine binary was started by the bench command.
+func Requested() bool {
+	return len(os.Args) == 3 && os.Args[1] == runCommand
+}
+
+// Run measures one call of aggregate over the file given on the command line and prints the result.
+func Run(aggregate func(filename string) error) {
+	res, err := Measure(func() error { return aggregate(os.Args[2]) })
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(res); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Measure runs fn and records its wall time, allocations and GC activity.
+func Measure(fn func() error) (Result, error) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	err := fn()
+	wall := time.Since(start)
+
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Wall:       wall,
+		Mallocs:    after.Mallocs - before.Mallocs,
+		TotalAlloc: after.TotalAlloc - before.TotalAlloc,
+		NumGC:      after.NumGC - before.NumGC,
+		GCPause:    time.Duration(after.PauseTotalNs - before.PauseTotalNs),
+	}, nil
+}
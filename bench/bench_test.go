@@ -0,0 +1,109 @@
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestGenerate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Generate(&buf, 5000, 50, 1); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	stations := map[string]bool{}
+	rows := 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		rows++
+		name, val, ok := strings.Cut(scanner.Text(), ";")
+		if !ok || name == "" || !utf8.ValidString(name) {
+			t.Fatalf("invalid line %q", scanner.Text())
+		}
+		v, err := strconv.ParseFloat(val, 64)
+		if err != nil || v < -99.9 || v > 99.9 || val[len(val)-2] != '.' {
+			t.Fatalf("invalid value in line %q", scanner.Text())
+		}
+		stations[name] = true
+	}
+	if rows != 5000 {
+		t.Errorf("expected 5000 rows, got %d", rows)
+	}
+	if len(stations) > 50 {
+		t.Errorf("expected at most 50 stations, got %d", len(stations))
+	}
+
+	var first, again bytes.Buffer
+	Generate(&first, 5000, 50, 1)
+	Generate(&again, 5000, 50, 1)
+	if !bytes.Equal(first.Bytes(), again.Bytes()) {
+		t.Errorf("same seed generated different datasets")
+	}
+}
+
+func TestUpdateReadme(t *testing.T) {
+	readme := `# Title
+
+| Solution | Execution Time | Key Optimizations |
+| -------- | -------------- | ----------------- |
+| s1       | 74.04s         | Baseline          |
+| s2       | 59.42s         | Bytes             |
+
+Footer
+`
+	expected := `# Title
+
+| Solution | Execution Time | Key Optimizations |
+| -------- | -------------- | ----------------- |
+| s1       | 70.50s         | Baseline          |
+| s2       | 59.42s         | Bytes             |
+
+Footer
+`
+
+	actual, err := UpdateReadme(readme, []Result{{Engine: "s1", Wall: 70500 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("UpdateReadme failed: %v", err)
+	}
+	if actual != expected {
+		t.Errorf("README mismatch\nExpected:\n%s\nActual:\n%s", expected, actual)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	runs := func(walls ...int) []Result {
+		res := make([]Result, len(walls))
+		for i, w := range walls {
+			res[i].Wall = time.Duration(w) * time.Millisecond
+		}
+		return res
+	}
+
+	base := []Record{
+		{Engine: "s1", Dataset: "d", Runs: runs(100, 101, 99, 100, 102)},
+		{Engine: "s2", Dataset: "d", Runs: runs(100, 101, 99, 100, 102)},
+		{Engine: "s3", Dataset: "d", Runs: runs(100, 150, 60, 100, 140)},
+	}
+	head := []Record{
+		{Engine: "s1", Dataset: "d", Runs: runs(120, 121, 119, 122, 120)}, // clearly slower
+		{Engine: "s2", Dataset: "d", Runs: runs(101, 100, 102, 99, 100)},  // same
+		{Engine: "s3", Dataset: "d", Runs: runs(110, 160, 70, 110, 150)},  // slower median, but too noisy to tell
+		{Engine: "s4", Dataset: "d", Runs: runs(100)},                     // no base
+	}
+
+	deltas := Compare(base, head, 0.05)
+	if len(deltas) != 3 {
+		t.Fatalf("expected 3 deltas, got %d", len(deltas))
+	}
+	for _, d := range deltas {
+		expected := d.Engine == "s1"
+		if d.Regression != expected {
+			t.Errorf("%s: expected regression %v, got %v (%+v)", d.Engine, expected, d.Regression, d)
+		}
+	}
+}
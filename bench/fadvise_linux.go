@@ -0,0 +1,29 @@
+//go:build linux && (amd64 || arm64)
+
+package bench
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const fadvDontNeed = 4 // POSIX_FADV_DONTNEED
+
+// DropCache asks the kernel to evict the file from the page cache, so the next read comes from disk.
+func DropCache(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("cannot sync file: %w", err)
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("posix_fadvise failed: %w", errno)
+	}
+	return nil
+}
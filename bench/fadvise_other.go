@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+
+package bench
+
+import "errors"
+
+// DropCache is only implemented on 64-bit Linux.
+func DropCache(filename string) error {
+	return errors.New("cold-cache runs need posix_fadvise, which is only supported on 64-bit linux")
+}
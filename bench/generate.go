@@ -0,0 +1,65 @@
+package bench
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var syllables = []string{
+	"ab", "ha", "ac", "cra", "ad", "dis", "la", "ide", "ber", "lin", "bo", "gota", "ca", "iro", "da", "kar",
+	"fu", "kuo", "ha", "noi", "ki", "ev", "lo", "me", "mos", "cow", "na", "ples", "o", "des", "pa", "ris",
+	"ri", "ga", "sa", "int", "to", "kyo", "va", "duz", "wa", "rsaw", "yo", "kohama", "zu", "rich",
+	// A few multi-byte ones so the engines see UTF-8 names
+	"né", "ché", "șin", "ău", "ü", "ña", "øy", "東", "京",
+}
+
+// Generate writes rows measurements for the given number of stations in the challenge format.
+// The output is fully determined by seed.
+func Generate(w io.Writer, rows int64, stations int, seed int64) error {
+	rnd := rand.New(rand.NewSource(seed))
+
+	names := make([]string, stations)
+	means := make([]float64, stations)
+	seen := make(map[string]bool, stations)
+	for i := range names {
+		var sb strings.Builder
+		for range 2 + rnd.Intn(3) {
+			sb.WriteString(syllables[rnd.Intn(len(syllables))])
+		}
+		first, size := utf8.DecodeRuneInString(sb.String())
+		name := string(unicode.ToUpper(first)) + sb.String()[size:]
+		if seen[name] {
+			name += " " + strconv.Itoa(i)
+		}
+		seen[name] = true
+		names[i] = name
+		means[i] = rnd.Float64()*60 - 20
+	}
+
+	bw := bufio.NewWriterSize(w, 1024*1024)
+	buf := make([]byte, 0, 128)
+	for range rows {
+		i := rnd.Intn(stations)
+		valX10 := int64((means[i] + rnd.NormFloat64()*10) * 10)
+		valX10 = max(-999, min(999, valX10))
+
+		buf = append(buf[:0], names[i]...)
+		buf = append(buf, ';')
+		if valX10 < 0 {
+			buf = append(buf, '-')
+			valX10 = -valX10
+		}
+		buf = strconv.AppendInt(buf, valX10/10, 10)
+		buf = append(buf, '.', byte('0'+valX10%10), '\n')
+		if _, err := bw.Write(buf); err != nil {
+			return fmt.Errorf("cannot write measurements: %w", err)
+		}
+	}
+	return bw.Flush()
+}
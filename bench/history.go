@@ -0,0 +1,170 @@
+package bench
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"slices"
+	"time"
+)
+
+// Record holds every run of one engine on one dataset, for a commit on a machine.
+type Record struct {
+	Commit  string    `json:"commit"`
+	Machine string    `json:"machine"`
+	Engine  string    `json:"engine"`
+	Dataset string    `json:"dataset"`
+	Date    time.Time `json:"date"`
+	Runs    []Result  `json:"runs"`
+}
+
+func (r Record) key() string {
+	return r.Commit + "\x00" + r.Machine + "\x00" + r.Engine + "\x00" + r.Dataset
+}
+
+type History struct {
+	Records []Record `json:"records"`
+}
+
+// LoadHistory reads the history file, a missing file is an empty history.
+func LoadHistory(filename string) (*History, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return &History{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var h History
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("invalid history file %q: %w", filename, err)
+	}
+	return &h, nil
+}
+
+func (h *History) Save(filename string) error {
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0o644)
+}
+
+// Add stores rec, replacing the record with the same commit, machine, engine and dataset.
+func (h *History) Add(rec Record) {
+	for i := range h.Records {
+		if h.Records[i].key() == rec.key() {
+			h.Records[i] = rec
+			return
+		}
+	}
+	h.Records = append(h.Records, rec)
+}
+
+// Find returns the records of a commit on a machine.
+func (h *History) Find(commit, machine string) []Record {
+	var recs []Record
+	for _, r := range h.Records {
+		if r.Commit == commit && r.Machine == machine {
+			recs = append(recs, r)
+		}
+	}
+	return recs
+}
+
+// Machine describes the current machine, results are only compared between runs on the same one.
+func Machine() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%s/%s/%dcpu", host, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+}
+
+// Summary is the median wall time of some runs with its 95% confidence interval.
+type Summary struct {
+	Median time.Duration
+	Low    time.Duration
+	High   time.Duration
+	Runs   int
+}
+
+const bootstrapSamples = 2000
+
+// Summarize computes the median wall time and a bootstrap confidence interval for it.
+// The bootstrap is seeded so the same runs always give the same interval.
+func Summarize(runs []Result) Summary {
+	walls := make([]time.Duration, len(runs))
+	for i, r := range runs {
+		walls[i] = r.Wall
+	}
+	if len(walls) == 0 {
+		return Summary{}
+	}
+
+	s := Summary{Median: median(walls), Runs: len(walls)}
+	if len(walls) == 1 {
+		s.Low, s.High = s.Median, s.Median
+		return s
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	medians := make([]time.Duration, bootstrapSamples)
+	sample := make([]time.Duration, len(walls))
+	for i := range medians {
+		for j := range sample {
+			sample[j] = walls[rnd.Intn(len(walls))]
+		}
+		medians[i] = median(sample)
+	}
+	slices.Sort(medians)
+	s.Low = medians[bootstrapSamples*25/1000]
+	s.High = medians[bootstrapSamples*975/1000-1]
+	return s
+}
+
+func median(walls []time.Duration) time.Duration {
+	sorted := slices.Clone(walls)
+	slices.Sort(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+type Delta struct {
+	Engine  string
+	Dataset string
+	Base    Summary
+	Head    Summary
+	Change  float64 // relative change of the median, 0.1 means 10% slower
+
+	// Regression is set when head is slower than base by more than the threshold
+	// and the confidence intervals don't overlap, so it's not just noise.
+	Regression bool
+}
+
+// Compare matches the records of base and head by engine and dataset.
+func Compare(base, head []Record, threshold float64) []Delta {
+	baseByKey := make(map[string]Record, len(base))
+	for _, r := range base {
+		baseByKey[r.Engine+"\x00"+r.Dataset] = r
+	}
+
+	var deltas []Delta
+	for _, h := range head {
+		b, ok := baseByKey[h.Engine+"\x00"+h.Dataset]
+		if !ok {
+			continue
+		}
+		d := Delta{Engine: h.Engine, Dataset: h.Dataset, Base: Summarize(b.Runs), Head: Summarize(h.Runs)}
+		if d.Base.Median > 0 {
+			d.Change = float64(d.Head.Median-d.Base.Median) / float64(d.Base.Median)
+		}
+		d.Regression = d.Change > threshold && d.Head.Low > d.Base.High
+		deltas = append(deltas, d)
+	}
+	return deltas
+}
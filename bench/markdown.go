@@ -0,0 +1,73 @@
+package bench
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MarkdownTable renders results with one row per run.
+func MarkdownTable(results []Result) string {
+	var sb strings.Builder
+	sb.WriteString("| Solution | Dataset | Execution Time | Throughput | Rows/s | Allocs | Peak RSS | GC Pauses |\n")
+	sb.WriteString("| -------- | ------- | -------------- | ---------- | ------ | ------ | -------- | --------- |\n")
+	for _, r := range results {
+		fmt.Fprintf(&sb, "| %s | %s | %.2fs | %.1f MB/s | %s | %d | %.1f MB | %d (%s) |\n",
+			r.Engine, r.Dataset, r.Wall.Seconds(), r.MBPerSec(), FormatCount(r.RowsPerSec()),
+			r.Mallocs, float64(r.MaxRSS)/1024/1024, r.NumGC, r.GCPause.Round(time.Microsecond))
+	}
+	return sb.String()
+}
+
+// UpdateReadme rewrites the Execution Time column of the solutions table in the README with the
+// given results, keeping the rest of the table (and the hand-written optimizations) untouched.
+func UpdateReadme(readme string, results []Result) (string, error) {
+	wall := make(map[string]time.Duration, len(results))
+	for _, r := range results {
+		wall[r.Engine] = r.Wall
+	}
+
+	lines := strings.Split(readme, "\n")
+	inTable := false
+	updated := 0
+	for i, line := range lines {
+		if strings.HasPrefix(line, "| Solution") && strings.Contains(line, "| Execution Time") {
+			inTable = true
+			continue
+		}
+		if !inTable {
+			continue
+		}
+		if !strings.HasPrefix(line, "|") {
+			break
+		}
+
+		cells := strings.Split(line, "|")
+		if len(cells) < 4 {
+			continue
+		}
+		d, ok := wall[strings.TrimSpace(cells[1])]
+		if !ok {
+			continue
+		}
+		width := len(cells[2]) - 2
+		cells[2] = " " + fmt.Sprintf("%-*s", width, fmt.Sprintf("%.2fs", d.Seconds())) + " "
+		lines[i] = strings.Join(cells, "|")
+		updated++
+	}
+
+	if updated == 0 {
+		return "", fmt.Errorf("no solution of the results found in the README table")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// FormatCount formats n with a K, M or B suffix and one decimal, as in 12.3M.
+func FormatCount(n float64) string {
+	units := []string{"", "K", "M", "B"}
+	i := 0
+	for ; n >= 1000 && i < len(units)-1; i++ {
+		n /= 1000
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
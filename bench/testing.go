@@ -0,0 +1,58 @@
+package bench
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/minhtri06/1brc/reference"
+)
+
+// Benchmark runs aggregate on the input file found by InputFile(def) in a b.Loop, reporting
+// throughput and allocations. Every engine's BenchmarkAggregate is a call to it.
+func Benchmark(b *testing.B, def string, aggregate func(filename string) error) {
+	inputFile := InputFile(def)
+	stat, err := os.Stat(inputFile)
+	if err != nil {
+		b.Fatalf("failed to stat input: %v", err)
+	}
+
+	b.SetBytes(stat.Size())
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := aggregate(inputFile); err != nil {
+			b.Fatalf("aggregate failed: %v", err)
+		}
+	}
+}
+
+// Differential checks aggregate against the reference implementation on n random datasets.
+// aggregate gets the dataset's index, the generator the dataset came from (so it can pick
+// options from the same seed) and the file holding it, and returns one reference.Line per
+// station.
+func Differential(t testing.TB, n int, aggregate func(i int, rnd *rand.Rand, filename string) (map[string]string, error)) {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(1))
+	for i := range n {
+		data := reference.RandomDataset(rnd)
+		inputFile := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(inputFile, data, 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+
+		actual, err := aggregate(i, rnd, inputFile)
+		if err != nil {
+			t.Fatalf("dataset %d: aggregate failed: %v", i, err)
+		}
+
+		ref, err := reference.Aggregate(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("dataset %d: reference aggregate failed: %v", i, err)
+		}
+		if diff := reference.Diff(reference.FormatCount(ref), actual); diff != "" {
+			t.Fatalf("dataset %d: result mismatch\n%s", i, diff)
+		}
+	}
+}
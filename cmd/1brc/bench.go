@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minhtri06/1brc/bench"
+)
+
+type dataset struct {
+	name     string
+	file     string
+	rows     int64
+	stations int
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	root := fs.String("root", ".", "root of the repository")
+	engines := fs.String("engines", "s1,s2,s3,s4,s5,s6,s7,s8,s9", "comma separated solutions to run")
+	rows := fs.String("rows", "1000000", "comma separated number of rows of the datasets")
+	stations := fs.String("stations", "10000", "comma separated number of stations of the datasets")
+	dataDir := fs.String("data", filepath.Join(os.TempDir(), "1brc-bench"), "directory the generated datasets are kept in")
+	seed := fs.Int64("seed", 1, "seed of the dataset generator")
+	runs := fs.Int("runs", 1, "runs per solution and dataset, the median is reported")
+	cold := fs.Bool("cold", false, "evict the dataset from the page cache before every run")
+	readme := fs.String("readme", "", "update the Execution Time column of this README with the results of the last dataset")
+	historyFile := fs.String("history", "", "JSON file to store every run in, for 1brc compare")
+	commit := fs.String("commit", "", "commit the results are stored under (default: current commit of root)")
+	machine := fs.String("machine", bench.Machine(), "machine the results are stored under")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *runs < 1 {
+		return fmt.Errorf("invalid number of runs %d, expected at least 1", *runs)
+	}
+
+	var history *bench.History
+	if *historyFile != "" {
+		var err error
+		if history, err = bench.LoadHistory(*historyFile); err != nil {
+			return err
+		}
+		if *commit == "" {
+			if *commit, err = gitCommit(*root); err != nil {
+				return err
+			}
+		}
+	}
+
+	datasets, err := prepareDatasets(*dataDir, *rows, *stations, *seed)
+	if err != nil {
+		return err
+	}
+
+	binDir, err := os.MkdirTemp("", "1brc-bench-bin")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(binDir)
+
+	engineList := strings.Split(*engines, ",")
+	for _, engine := range engineList {
+		if err := buildEngine(*root, engine, binDir); err != nil {
+			return err
+		}
+	}
+
+	var results, last []bench.Result
+	for _, ds := range datasets {
+		last = last[:0]
+		for _, engine := range engineList {
+			runResults := make([]bench.Result, 0, *runs)
+			for i := range *runs {
+				fmt.Fprintf(os.Stderr, "bench: %s on %s, run %d/%d\n", engine, ds.name, i+1, *runs)
+				res, err := runEngine(filepath.Join(binDir, engine), ds, *cold)
+				if err != nil {
+					return fmt.Errorf("%s on %s: %w", engine, ds.name, err)
+				}
+				res.Engine = engine
+				runResults = append(runResults, res)
+			}
+			if history != nil {
+				history.Add(bench.Record{
+					Commit:  *commit,
+					Machine: *machine,
+					Engine:  engine,
+					Dataset: ds.name,
+					Date:    time.Now().UTC(),
+					Runs:    runResults,
+				})
+			}
+			median := medianRun(runResults)
+			results = append(results, median)
+			last = append(last, median)
+		}
+	}
+
+	fmt.Print(bench.MarkdownTable(results))
+
+	if history != nil {
+		if err := history.Save(*historyFile); err != nil {
+			return err
+		}
+	}
+
+	if *readme != "" {
+		content, err := os.ReadFile(*readme)
+		if err != nil {
+			return err
+		}
+		updated, err := bench.UpdateReadme(string(content), last)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*readme, []byte(updated), 0o644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prepareDatasets generates every combination of rows and stations, reusing files generated by earlier runs.
+func prepareDatasets(dir, rows, stations string, seed int64) ([]dataset, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	var datasets []dataset
+	for _, r := range strings.Split(rows, ",") {
+		numRows, err := strconv.ParseFloat(strings.TrimSpace(r), 64) // accepts 1e9
+		if err != nil {
+			return nil, fmt.Errorf("invalid number of rows %q: %w", r, err)
+		}
+		for _, s := range strings.Split(stations, ",") {
+			numStations, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || numStations < 1 {
+				return nil, fmt.Errorf("invalid number of stations %q", s)
+			}
+
+			ds := dataset{
+				name:     fmt.Sprintf("%s rows/%d stations", r, numStations),
+				file:     filepath.Join(dir, fmt.Sprintf("measurements_%d_%d_%d.txt", int64(numRows), numStations, seed)),
+				rows:     int64(numRows),
+				stations: numStations,
+			}
+			if _, err := os.Stat(ds.file); err != nil {
+				fmt.Fprintf(os.Stderr, "bench: generating %s\n", ds.file)
+				if err := generateDataset(ds, seed); err != nil {
+					return nil, err
+				}
+			}
+			datasets = append(datasets, ds)
+		}
+	}
+	return datasets, nil
+}
+
+func generateDataset(ds dataset, seed int64) error {
+	tmp := ds.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := bench.Generate(f, ds.rows, ds.stations, seed); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ds.file)
+}
+
+func buildEngine(root, engine, binDir string) error {
+	cmd := exec.Command("go", "build", "-o", filepath.Join(binDir, engine), "./"+engine)
+	cmd.Dir = root
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot build %s: %w", engine, err)
+	}
+	return nil
+}
+
+// runEngine runs the engine binary once in its own process.
+func runEngine(bin string, ds dataset, cold bool) (bench.Result, error) {
+	if cold {
+		if err := bench.DropCache(ds.file); err != nil {
+			return bench.Result{}, err
+		}
+	} else if err := warmCache(ds.file); err != nil {
+		return bench.Result{}, err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(bin, "bench-run", ds.file)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return bench.Result{}, err
+	}
+
+	var res bench.Result
+	if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
+		return bench.Result{}, fmt.Errorf("invalid bench output: %w", err)
+	}
+	stat, err := os.Stat(ds.file)
+	if err != nil {
+		return bench.Result{}, err
+	}
+	res.Dataset = ds.name
+	res.Bytes = stat.Size()
+	res.Rows = ds.rows
+	res.ColdRead = cold
+	res.MaxRSS = maxRSS(cmd.ProcessState)
+	return res, nil
+}
+
+// warmCache reads the whole file so it's in the page cache before the timed run.
+func warmCache(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(io.Discard, f)
+	return err
+}
+
+func medianRun(runs []bench.Result) bench.Result {
+	sorted := slices.Clone(runs)
+	slices.SortFunc(sorted, func(a, b bench.Result) int { return cmp.Compare(a.Wall, b.Wall) })
+	return sorted[len(sorted)/2]
+}
+
+// gitCommit returns the short hash of HEAD in root, with a -dirty suffix when there are local changes.
+func gitCommit(root string) (string, error) {
+	out, err := exec.Command("git", "-C", root, "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot get current commit, use -commit: %w", err)
+	}
+	commit := strings.TrimSpace(string(out))
+
+	status, err := exec.Command("git", "-C", root, "status", "--porcelain").Output()
+	if err == nil && len(bytes.TrimSpace(status)) > 0 {
+		commit += "-dirty"
+	}
+	return commit, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/minhtri06/1brc/bench"
+)
+
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	root := fs.String("root", ".", "root of the repository")
+	historyFile := fs.String("history", "bench-history.json", "JSON file written by 1brc bench -history")
+	base := fs.String("base", "", "commit to compare against")
+	head := fs.String("head", "", "commit to check (default: current commit of root)")
+	machine := fs.String("machine", bench.Machine(), "only compare results from this machine")
+	threshold := fs.Float64("threshold", 0.05, "relative slowdown of the median that counts as a regression")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *base == "" {
+		return fmt.Errorf("-base is required")
+	}
+
+	history, err := bench.LoadHistory(*historyFile)
+	if err != nil {
+		return err
+	}
+	if *head == "" {
+		if *head, err = gitCommit(*root); err != nil {
+			return err
+		}
+	}
+
+	deltas := bench.Compare(history.Find(*base, *machine), history.Find(*head, *machine), *threshold)
+	if len(deltas) == 0 {
+		return fmt.Errorf("no results to compare between %s and %s on %s", *base, *head, *machine)
+	}
+
+	regressions := 0
+	fmt.Printf("| Solution | Dataset | %s | %s | Change | |\n", *base, *head)
+	fmt.Println("| -------- | ------- | --- | --- | ------ | - |")
+	for _, d := range deltas {
+		verdict := ""
+		if d.Regression {
+			verdict = "REGRESSION"
+			regressions++
+		}
+		fmt.Printf("| %s | %s | %s | %s | %+.1f%% | %s |\n",
+			d.Engine, d.Dataset, formatSummary(d.Base), formatSummary(d.Head), d.Change*100, verdict)
+	}
+
+	if regressions > 0 {
+		fmt.Fprintf(os.Stderr, "%d regression(s) above %.1f%%\n", regressions, *threshold*100)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func formatSummary(s bench.Summary) string {
+	return fmt.Sprintf("%.3fs [%.3f, %.3f] n=%d", s.Median.Seconds(), s.Low.Seconds(), s.High.Seconds(), s.Runs)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/minhtri06/1brc/writeresult"
+)
+
+// runDiff exits like diff(1): 0 when the results match, 1 when they differ and 2 when they can't be compared.
+func runDiff(args []string) error {
+	report, err := diffFiles(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fmt.Print(report)
+	if !report.Equal() {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func diffFiles(args []string) (*writeresult.DiffReport, error) {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	tolerance := fs.Float64("tolerance", 0, "largest absolute difference of min, mean or max that still counts as equal")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 2 {
+		return nil, errors.New("usage: 1brc diff [-tolerance 0.1] expected.txt actual.txt")
+	}
+	if *tolerance < 0 {
+		return nil, fmt.Errorf("invalid tolerance %v", *tolerance)
+	}
+
+	expected, err := writeresult.ReadFile(fs.Arg(0))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", fs.Arg(0), err)
+	}
+	actual, err := writeresult.ReadFile(fs.Arg(1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", fs.Arg(1), err)
+	}
+	return writeresult.Diff(expected, actual, *tolerance), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// 1brc holds the tools that work across every solution, the solutions themselves stay in s1..s9.
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: 1brc <command> [flags]\n\ncommands:\n  bench    run every solution over generated datasets\n  compare  detect regressions between two commits in the bench history\n  diff     compare two result files with a tolerance")
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "bench":
+		err = runBench(os.Args[2:])
+	case "compare":
+		err = runCompare(os.Args[2:])
+	case "diff":
+		err = runDiff(os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// maxRSS is not available on this platform.
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
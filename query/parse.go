@@ -0,0 +1,333 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokSymbol // , ( ) * and comparison operators
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			var b strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			tokens = append(tokens, token{tokString, b.String(), start})
+		case c >= '0' && c <= '9' || c == '.' || c == '-' && i+1 < len(s) && (s[i+1] >= '0' && s[i+1] <= '9' || s[i+1] == '.'):
+			start := i
+			for i++; i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.' || s[i] == 'e' || s[i] == 'E'); i++ {
+			}
+			tokens = append(tokens, token{tokNumber, s[start:i], start})
+		case isLetter(c):
+			start := i
+			for i < len(s) && (isLetter(s[i]) || s[i] >= '0' && s[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, s[start:i], start})
+		case strings.IndexByte(",()*", c) >= 0:
+			tokens = append(tokens, token{tokSymbol, string(c), i})
+			i++
+		case strings.IndexByte("=!<>", c) >= 0:
+			start := i
+			i++
+			if i < len(s) && (s[i] == '=' || c == '<' && s[i] == '>') {
+				i++
+			}
+			op := s[start:i]
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected %q at %d", op, start)
+			}
+			if op == "<>" {
+				op = "!="
+			}
+			tokens = append(tokens, token{tokSymbol, op, start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(s)}), nil
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type parser struct {
+	tokens []token
+	i      int
+}
+
+// Parse parses a query, see the package documentation for the syntax.
+func Parse(s string) (*Query, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	q, err := p.query()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return q, nil
+}
+
+func (p *parser) peek() token { return p.tokens[p.i] }
+
+// keyword consumes the next token if it's the keyword kw.
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokIdent && strings.EqualFold(t.text, kw) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) symbol(s string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == s {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expected(what string) error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("expected %s at the end", what)
+	}
+	return fmt.Errorf("expected %s at %d, got %q", what, t.pos, t.text)
+}
+
+var keywords = []string{"SELECT", "WHERE", "ORDER", "BY", "ASC", "DESC", "LIMIT", "AND", "OR", "NOT", "IN", "LIKE"}
+
+func (p *parser) column() (string, error) {
+	t := p.peek()
+	if t.kind != tokIdent {
+		return "", p.expected("a column")
+	}
+	for _, kw := range keywords {
+		if strings.EqualFold(t.text, kw) {
+			return "", p.expected("a column")
+		}
+	}
+	p.i++
+	return strings.ToLower(t.text), nil
+}
+
+func (p *parser) query() (*Query, error) {
+	q := &Query{Limit: -1}
+	if !p.keyword("SELECT") {
+		return nil, p.expected("SELECT")
+	}
+	if !p.symbol("*") {
+		for {
+			c, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			q.Select = append(q.Select, c)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("WHERE") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		q.Where = e
+	}
+
+	if p.keyword("ORDER") {
+		if !p.keyword("BY") {
+			return nil, p.expected("BY")
+		}
+		for {
+			c, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			o := Order{Column: c}
+			if p.keyword("DESC") {
+				o.Desc = true
+			} else {
+				p.keyword("ASC")
+			}
+			q.OrderBy = append(q.OrderBy, o)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		t := p.peek()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || n < 0 {
+			return nil, p.expected("a number of rows")
+		}
+		p.i++
+		q.Limit = n
+	}
+	return q, nil
+}
+
+func (p *parser) or() (Expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (Expr, error) {
+	if p.keyword("NOT") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{e}, nil
+	}
+	if p.symbol("(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.expected(")")
+		}
+		return e, nil
+	}
+	return p.compare()
+}
+
+func (p *parser) compare() (Expr, error) {
+	c, err := p.column()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("IN") {
+		if !p.symbol("(") {
+			return nil, p.expected("(")
+		}
+		e := &Compare{Column: c, Op: "IN"}
+		for {
+			v, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			e.Values = append(e.Values, v)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if !p.symbol(")") {
+			return nil, p.expected(")")
+		}
+		return e, nil
+	}
+
+	if p.keyword("LIKE") {
+		t := p.peek()
+		if t.kind != tokString {
+			return nil, p.expected("a string pattern")
+		}
+		p.i++
+		return &Compare{Column: c, Op: "LIKE", Values: []Value{String(t.text)}, like: Like(t.text)}, nil
+	}
+
+	t := p.peek()
+	switch t.text {
+	case "=", "!=", "<", "<=", ">", ">=":
+		if t.kind != tokSymbol {
+			break
+		}
+		p.i++
+		v, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return &Compare{Column: c, Op: t.text, Values: []Value{v}}, nil
+	}
+	return nil, p.expected("a comparison")
+}
+
+func (p *parser) literal() (Value, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokString:
+		p.i++
+		return String(t.text), nil
+	case tokNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		p.i++
+		return Number(v), nil
+	}
+	return Value{}, p.expected("a number or a string")
+}
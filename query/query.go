@@ -0,0 +1,257 @@
+// Package query is a small SQL-like language over aggregation results:
+//
+//	SELECT name, mean WHERE country = 'VN' AND max > 40 ORDER BY mean DESC LIMIT 10
+//
+// A query has no FROM, it runs over the rows it's given, one per station. Keywords are case-insensitive,
+// strings are single quoted (a quote is doubled), and WHERE supports =, !=, <>, <, <=, >, >=, IN (...), LIKE
+// with % and _, AND, OR, NOT and parentheses.
+package query
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Value is a number or a string.
+type Value struct {
+	Str   string
+	Num   float64
+	IsNum bool
+}
+
+func Number(v float64) Value { return Value{Num: v, IsNum: true} }
+func String(s string) Value  { return Value{Str: s} }
+
+func (v Value) String() string {
+	if v.IsNum {
+		return strconv.FormatFloat(v.Num, 'f', -1, 64)
+	}
+	return v.Str
+}
+
+// compare orders numbers before strings, so mixed columns still sort.
+func (v Value) compare(o Value) int {
+	switch {
+	case v.IsNum && o.IsNum:
+		return cmp.Compare(v.Num, o.Num)
+	case v.IsNum:
+		return -1
+	case o.IsNum:
+		return 1
+	}
+	return strings.Compare(v.Str, o.Str)
+}
+
+// Row is one station of the results, by column name. A missing column evaluates to an empty string.
+type Row map[string]Value
+
+type Query struct {
+	Select  []string // nil for *
+	Where   Expr     // nil without WHERE
+	OrderBy []Order
+	Limit   int // -1 without LIMIT
+}
+
+type Order struct {
+	Column string
+	Desc   bool
+}
+
+// Expr is a boolean expression of a WHERE clause: *And, *Or, *Not or *Compare.
+type Expr interface {
+	eval(Row) bool
+	String() string
+}
+
+type And struct{ Left, Right Expr }
+type Or struct{ Left, Right Expr }
+type Not struct{ Expr Expr }
+
+// Compare compares a column with literals: Op is one of = != < <= > >= IN LIKE, only IN has several Values.
+type Compare struct {
+	Column string
+	Op     string
+	Values []Value
+
+	like *regexp.Regexp
+}
+
+func (e *And) eval(r Row) bool { return e.Left.eval(r) && e.Right.eval(r) }
+func (e *Or) eval(r Row) bool  { return e.Left.eval(r) || e.Right.eval(r) }
+func (e *Not) eval(r Row) bool { return !e.Expr.eval(r) }
+
+func (e *Compare) eval(r Row) bool {
+	v := r[e.Column]
+	switch e.Op {
+	case "IN":
+		return slices.ContainsFunc(e.Values, func(o Value) bool { return v.compare(o) == 0 })
+	case "LIKE":
+		return e.like.MatchString(v.String())
+	}
+	c := v.compare(e.Values[0])
+	switch e.Op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func (e *And) String() string { return "(" + e.Left.String() + " AND " + e.Right.String() + ")" }
+func (e *Or) String() string  { return "(" + e.Left.String() + " OR " + e.Right.String() + ")" }
+func (e *Not) String() string { return "NOT " + e.Expr.String() }
+
+func (e *Compare) String() string {
+	values := make([]string, len(e.Values))
+	for i, v := range e.Values {
+		values[i] = quote(v)
+	}
+	if e.Op == "IN" {
+		return e.Column + " IN (" + strings.Join(values, ", ") + ")"
+	}
+	return e.Column + " " + e.Op + " " + values[0]
+}
+
+func quote(v Value) string {
+	if v.IsNum {
+		return v.String()
+	}
+	return "'" + strings.ReplaceAll(v.Str, "'", "''") + "'"
+}
+
+// Like turns a LIKE pattern into an anchored regular expression.
+func Like(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// Conjuncts splits an expression into the terms of its top-level ANDs, which can each be handled on their own.
+func Conjuncts(e Expr) []Expr {
+	if and, ok := e.(*And); ok {
+		return append(Conjuncts(and.Left), Conjuncts(and.Right)...)
+	}
+	if e == nil {
+		return nil
+	}
+	return []Expr{e}
+}
+
+// Conjoin is the inverse of Conjuncts, nil for no terms.
+func Conjoin(terms []Expr) Expr {
+	var e Expr
+	for _, t := range terms {
+		if e == nil {
+			e = t
+		} else {
+			e = &And{e, t}
+		}
+	}
+	return e
+}
+
+// Columns returns every column the query reads, the selected ones first.
+func (q *Query) Columns() []string {
+	var columns []string
+	add := func(c string) {
+		if !slices.Contains(columns, c) {
+			columns = append(columns, c)
+		}
+	}
+	for _, c := range q.Select {
+		add(c)
+	}
+	var walk func(Expr)
+	walk = func(e Expr) {
+		switch e := e.(type) {
+		case *And:
+			walk(e.Left)
+			walk(e.Right)
+		case *Or:
+			walk(e.Left)
+			walk(e.Right)
+		case *Not:
+			walk(e.Expr)
+		case *Compare:
+			add(e.Column)
+		}
+	}
+	walk(q.Where)
+	for _, o := range q.OrderBy {
+		add(o.Column)
+	}
+	return columns
+}
+
+// Result is a table of the selected columns.
+type Result struct {
+	Columns []string
+	Rows    [][]Value
+}
+
+// Run evaluates the query over rows, columns are every column rows have (in the order of SELECT *).
+// Columns the query uses but rows don't have are an error.
+func (q *Query) Run(columns []string, rows []Row) (*Result, error) {
+	for _, c := range q.Columns() {
+		if !slices.Contains(columns, c) {
+			return nil, fmt.Errorf("unknown column %q, expected one of %s", c, strings.Join(columns, ", "))
+		}
+	}
+
+	var matched []Row
+	for _, r := range rows {
+		if q.Where == nil || q.Where.eval(r) {
+			matched = append(matched, r)
+		}
+	}
+	slices.SortStableFunc(matched, func(a, b Row) int {
+		for _, o := range q.OrderBy {
+			c := a[o.Column].compare(b[o.Column])
+			if o.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+	if q.Limit >= 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+
+	res := &Result{Columns: q.Select}
+	if res.Columns == nil {
+		res.Columns = columns
+	}
+	for _, r := range matched {
+		values := make([]Value, len(res.Columns))
+		for i, c := range res.Columns {
+			values[i] = r[c]
+		}
+		res.Rows = append(res.Rows, values)
+	}
+	return res, nil
+}
@@ -0,0 +1,142 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // the query printed back, "" for an error
+	}{
+		{"SELECT *", "SELECT *"},
+		{"select name, mean where country='VN' and max > 40 order by mean desc limit 10",
+			"SELECT name, mean WHERE (country = 'VN' AND max > 40) ORDER BY mean DESC LIMIT 10"},
+		{"SELECT name WHERE a = 1 OR b = 2 AND NOT c <> 'x'", "SELECT name WHERE (a = 1 OR (b = 2 AND NOT c != 'x'))"},
+		{"SELECT name WHERE (a = 1 OR b = 2) AND c >= -1.5", "SELECT name WHERE ((a = 1 OR b = 2) AND c >= -1.5)"},
+		{"SELECT name WHERE name IN ('Abha', 'O''Higgins') AND name LIKE 'A%'", "SELECT name WHERE (name IN ('Abha', 'O''Higgins') AND name LIKE 'A%')"},
+		{"SELECT name ORDER BY max, min DESC", "SELECT name ORDER BY max ASC, min DESC"},
+		{"", ""},
+		{"SELECT", ""},
+		{"SELECT name WHERE", ""},
+		{"SELECT name WHERE max >", ""},
+		{"SELECT name WHERE max ! 3", ""},
+		{"SELECT name WHERE name = 'Abha", ""},
+		{"SELECT name LIMIT x", ""},
+		{"SELECT name LIMIT -1", ""},
+		{"SELECT name ORDER mean", ""},
+		{"SELECT where", ""},
+		{"SELECT name WHERE (max > 1", ""},
+		{"SELECT name FROM stations", ""},
+	}
+	for _, tt := range tests {
+		q, err := Parse(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("Parse(%q) = %s, expected an error", tt.in, format(q))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got := format(q); got != tt.want {
+			t.Errorf("Parse(%q) = %s, expected %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func format(q *Query) string {
+	var b strings.Builder
+	b.WriteString("SELECT ")
+	if q.Select == nil {
+		b.WriteString("*")
+	}
+	b.WriteString(strings.Join(q.Select, ", "))
+	if q.Where != nil {
+		b.WriteString(" WHERE " + q.Where.String())
+	}
+	for i, o := range q.OrderBy {
+		if i == 0 {
+			b.WriteString(" ORDER BY ")
+		} else {
+			b.WriteString(", ")
+		}
+		b.WriteString(o.Column)
+		if o.Desc {
+			b.WriteString(" DESC")
+		} else {
+			b.WriteString(" ASC")
+		}
+	}
+	if q.Limit >= 0 {
+		b.WriteString(" LIMIT " + Number(float64(q.Limit)).String())
+	}
+	return b.String()
+}
+
+func TestRun(t *testing.T) {
+	columns := []string{"name", "country", "mean", "max"}
+	rows := []Row{
+		{"name": String("Hanoi"), "country": String("VN"), "mean": Number(23.6), "max": Number(41.2)},
+		{"name": String("Da Nang"), "country": String("VN"), "mean": Number(25.8), "max": Number(39.9)},
+		{"name": String("Ho Chi Minh City"), "country": String("VN"), "mean": Number(27.4), "max": Number(43.0)},
+		{"name": String("Abha"), "country": String("SA"), "mean": Number(18.0), "max": Number(45.1)},
+	}
+
+	q, err := Parse("SELECT name, mean WHERE country='VN' AND max > 40 ORDER BY mean DESC LIMIT 10")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	res, err := q.Run(columns, rows)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	want := &Result{
+		Columns: []string{"name", "mean"},
+		Rows: [][]Value{
+			{String("Ho Chi Minh City"), Number(27.4)},
+			{String("Hanoi"), Number(23.6)},
+		},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("got %+v, expected %+v", res, want)
+	}
+
+	q, _ = Parse("SELECT * WHERE name LIKE '%a%' AND NOT name IN ('Abha') ORDER BY name LIMIT 1")
+	res, err = q.Run(columns, rows)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if len(res.Rows) != 1 || res.Rows[0][0] != String("Da Nang") || !reflect.DeepEqual(res.Columns, columns) {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	q, _ = Parse("SELECT name, p95")
+	if _, err := q.Run(columns, rows); err == nil || !strings.Contains(err.Error(), "p95") {
+		t.Errorf("expected an unknown column error, got %v", err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{"SELECT *", "SELECT name, mean WHERE country='VN' AND max > 40 ORDER BY mean DESC LIMIT 10", "SELECT name WHERE name IN ('a', 'b''c') OR NOT (x LIKE '_%')"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		q, err := Parse(in)
+		if err != nil {
+			return
+		}
+		// What parses must print back into the same query
+		again, err := Parse(format(q))
+		if err != nil {
+			t.Fatalf("Parse(%q) = %s, which doesn't parse: %v", in, format(q), err)
+		}
+		if format(again) != format(q) {
+			t.Errorf("Parse(%q) = %s, printed back it's %s", in, format(q), format(again))
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package reference
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"unicode/utf8"
+)
+
+// nameRunes are the runes random station names are built from, ASCII plus some multi-byte ones
+// so that names cross buffer and part boundaries in the middle of a rune.
+var nameRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ -.,'()éèçñüößøåăâîșțđơư東京Москва")
+
+// RandomDataset returns a dataset that follows the rules of the challenge, with a random number of rows,
+// a random set of stations and one of a few value distributions.
+func RandomDataset(rnd *rand.Rand) []byte {
+	stations := make([]string, 1+rnd.Intn(500))
+	for i := range stations {
+		stations[i] = randomName(rnd)
+	}
+
+	var valX10 func() int64
+	switch rnd.Intn(4) {
+	case 0: // uniform over the whole range
+		valX10 = func() int64 { return rnd.Int63n(1999) - 999 }
+	case 1: // normal around a plausible temperature
+		valX10 = func() int64 { return max(-999, min(999, int64((15+rnd.NormFloat64()*10)*10))) }
+	case 2: // only the extremes
+		valX10 = func() int64 { return []int64{-999, 999, 0, -1, 1}[rnd.Intn(5)] }
+	default: // a single value
+		v := rnd.Int63n(1999) - 999
+		valX10 = func() int64 { return v }
+	}
+
+	rows := rnd.Intn(5000)
+	var buf bytes.Buffer
+	for range rows {
+		buf.WriteString(stations[rnd.Intn(len(stations))])
+		buf.WriteByte(';')
+		v := valX10()
+		if v < 0 {
+			buf.WriteByte('-')
+			v = -v
+		}
+		buf.WriteString(strconv.FormatInt(v/10, 10))
+		buf.WriteByte('.')
+		buf.WriteByte(byte('0' + v%10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// randomName returns a valid UTF-8 name of 1 to 100 bytes.
+func randomName(rnd *rand.Rand) string {
+	n := 1 + rnd.Intn(30)
+	name := make([]byte, 0, 100)
+	for range n {
+		r := nameRunes[rnd.Intn(len(nameRunes))]
+		if len(name)+utf8.RuneLen(r) > 100 {
+			break
+		}
+		name = utf8.AppendRune(name, r)
+	}
+	return string(name)
+}
@@ -0,0 +1,157 @@
+// Package reference is the strict parser of solution 1, shared by the tests of the other solutions
+// so they can check their fast parsers against it.
+package reference
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// challengeValue matches a value in -99.9..99.9 with exactly one fractional digit.
+var challengeValue = regexp.MustCompile(`^-?[0-9]{1,2}\.[0-9]$`)
+
+// IsChallengeLine reports whether line (without the newline) follows the rules of the challenge:
+// a valid UTF-8 name of 1 to 100 bytes without ';' or '\n', and a value accepted by IsChallengeValue.
+func IsChallengeLine(line string) bool {
+	name, val, ok := strings.Cut(line, ";")
+	if !ok || len(name) < 1 || len(name) > 100 || strings.ContainsRune(name, '\n') || !utf8.ValidString(name) {
+		return false
+	}
+	return IsChallengeValue(val)
+}
+
+// IsChallengeValue reports whether val follows the rules of the challenge.
+func IsChallengeValue(val string) bool {
+	return challengeValue.MatchString(val)
+}
+
+// ParseLine parses a line the way solution 1 does.
+func ParseLine(line string) (name string, val float64, err error) {
+	sepIdx := strings.Index(line, ";")
+	if sepIdx == -1 {
+		return "", 0, fmt.Errorf("invalid format: %q", line)
+	}
+	name, valStr := line[:sepIdx], line[sepIdx+1:]
+
+	val, err = strconv.ParseFloat(valStr, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid value: %w", err)
+	}
+	return name, val, nil
+}
+
+// ValX10 returns val multiplied by 10 as an integer, like the fast parsers do.
+func ValX10(val float64) int64 {
+	return int64(math.Round(val * 10))
+}
+
+type Stats struct {
+	Min    float64
+	Max    float64
+	SumX10 int64
+	Count  int64
+}
+
+func (s *Stats) Mean() float64 {
+	return float64(s.SumX10) / float64(s.Count) / 10
+}
+
+// Aggregate reads every line of r with ParseLine.
+func Aggregate(r io.Reader) (map[string]*Stats, error) {
+	agg := map[string]*Stats{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		name, val, err := ParseLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", lineNum, err)
+		}
+
+		s, ok := agg[name]
+		if !ok {
+			agg[name] = &Stats{Min: val, Max: val, SumX10: ValX10(val), Count: 1}
+			continue
+		}
+		s.Min = min(s.Min, val)
+		s.Max = max(s.Max, val)
+		s.SumX10 += ValX10(val)
+		s.Count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan %w", err)
+	}
+
+	return agg, nil
+}
+
+// Format formats the aggregation the way writeresult expects.
+func Format(agg map[string]*Stats) map[string]string {
+	res := make(map[string]string, len(agg))
+	for name, s := range agg {
+		res[name] = fmt.Sprintf("%.1f/%.1f/%.1f", s.Min, s.Mean(), s.Max)
+	}
+	return res
+}
+
+// Line formats one station with its count, so comparing results also compares counts.
+func Line(min, mean, max float64, count int64) string {
+	return fmt.Sprintf("%.1f/%.1f/%.1f (%d rows)", min, mean, max, count)
+}
+
+// FormatCount formats every station with Line.
+func FormatCount(agg map[string]*Stats) map[string]string {
+	res := make(map[string]string, len(agg))
+	for name, s := range agg {
+		res[name] = Line(s.Min, s.Mean(), s.Max, s.Count)
+	}
+	return res
+}
+
+// Diff describes the differences between two formatted results, at most maxDiffs of them.
+// It returns an empty string when they are the same.
+func Diff(expected, actual map[string]string) string {
+	const maxDiffs = 10
+
+	names := make([]string, 0, len(expected)+len(actual))
+	for name := range expected {
+		names = append(names, name)
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	diffs := 0
+	for _, name := range names {
+		e, inExpected := expected[name]
+		a, inActual := actual[name]
+		switch {
+		case !inActual:
+			fmt.Fprintf(&sb, "missing %q: expected %s\n", name, e)
+		case !inExpected:
+			fmt.Fprintf(&sb, "extra %q: got %s\n", name, a)
+		case e != a:
+			fmt.Fprintf(&sb, "%q: expected %s, got %s\n", name, e, a)
+		default:
+			continue
+		}
+		diffs++
+		if diffs == maxDiffs {
+			sb.WriteString("...\n")
+			break
+		}
+	}
+	return sb.String()
+}
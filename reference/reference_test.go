@@ -0,0 +1,72 @@
+package reference
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/minhtri06/1brc/writeresult"
+)
+
+func TestAggregate(t *testing.T) {
+	f, err := os.Open("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to open input: %v", err)
+	}
+	defer f.Close()
+
+	agg, err := Aggregate(f)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	tmpOutput := filepath.Join(t.TempDir(), "result.txt")
+	if err := writeresult.ToFile(tmpOutput, Format(agg)); err != nil {
+		t.Fatalf("writeresult.ToFile failed: %v", err)
+	}
+
+	expected, err := os.ReadFile("../output_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read expected output: %v", err)
+	}
+	actual, err := os.ReadFile(tmpOutput)
+	if err != nil {
+		t.Fatalf("failed to read actual output: %v", err)
+	}
+	if string(expected) != string(actual) {
+		t.Errorf("output mismatch\n%s", writeresult.DiffOutputs(string(expected), string(actual)))
+	}
+}
+
+func TestIsChallengeLine(t *testing.T) {
+	for line, expected := range map[string]bool{
+		"Abha;12.3":    true,
+		"Abéché;-99.9": true,
+		"A;0.0":        true,
+		";1.0":         false,
+		"Abha;123.4":   false,
+		"Abha;1.23":    false,
+		"Abha;12":      false,
+		"Ab;ha;1.0":    false,
+		"Abha;+1.0":    false,
+		"Ab\xffa;1.0":  false,
+	} {
+		if IsChallengeLine(line) != expected {
+			t.Errorf("IsChallengeLine(%q): expected %v", line, expected)
+		}
+	}
+}
+
+func TestRandomDataset(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for range 20 {
+		data := RandomDataset(rnd)
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			if len(data) > 0 && !IsChallengeLine(line) {
+				t.Fatalf("invalid line %q", line)
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/minhtri06/1brc/bench"
+)
+
+// There is no TestAggregate: this solution sums floats, so a few means are rounded off by 0.1 from output_small.txt.
+
+func TestAggregateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := aggregateContext(ctx, "../measurements_small.txt"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	bench.Benchmark(b, "../measurements_small.txt", func(filename string) error {
+		_, err := aggregate(filename)
+		return err
+	})
+}
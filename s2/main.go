@@ -3,15 +3,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"runtime/pprof"
+
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/schema"
 )
 
 // This solution is the same as solution 1, but added some optimizations:
 // - It processes station names and values in bytes -> reduce the time for string allocation.
 // - It uses sumX10 (x10), making it an integer -> more accurate than floating point numbers.
+// Other layouts than the challenge one are read with schema.Schema.ParseValue, sumX10 is then scaled by 10^Scale.
 
 type Aggregation struct {
 	min  float64
@@ -24,7 +29,17 @@ type Aggregation struct {
 
 const inputFile = "../measurements.txt"
 
+// ctxCheckInterval is how many lines are read between two checks of the context.
+const ctxCheckInterval = 1 << 16
+
 func main() {
+	if bench.Requested() {
+		bench.Run(func(filename string) error {
+			_, err := aggregate(filename)
+			return err
+		})
+		return
+	}
 	f, err := os.Create("cpu.prof")
 	if err != nil {
 		panic(fmt.Errorf("cannot create prof file: %w", err))
@@ -43,6 +58,25 @@ func main() {
 }
 
 func aggregate(inputFile string) (map[string]*Aggregation, error) {
+	return aggregateContext(context.Background(), inputFile, schema.Default)
+}
+
+// aggregateContext is aggregate for files laid out as sch, it gives up as soon as ctx is done.
+// Only single-column schemas without timestamps are supported.
+func aggregateContext(ctx context.Context, inputFile string, sch schema.Schema) (map[string]*Aggregation, error) {
+	if err := sch.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if sch.NumColumns() > 1 || sch.Time != schema.TimeNone {
+		return nil, errors.New("only schemas with a single value column and no timestamp are supported")
+	}
+	// The challenge format keeps the hand-written parser
+	parse := evaluateValX10
+	if !sch.IsDefault() {
+		parse = sch.ParseValue
+	}
+	divisor := sch.Divisor()
+
 	file, err := os.Open(inputFile)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file: %w", err)
@@ -54,10 +88,15 @@ func aggregate(inputFile string) (map[string]*Aggregation, error) {
 	lineNum := 0
 
 	for scanner.Scan() {
+		if lineNum%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("stopped after %v lines: %w", lineNum, err)
+			}
+		}
 		lineNum++
 		line := scanner.Bytes()
 
-		newlineIdx := bytes.IndexByte(line, ';')
+		newlineIdx := bytes.IndexByte(line, sch.Separator)
 		if newlineIdx == -1 {
 			return nil, fmt.Errorf("could not find name-value separator")
 		}
@@ -66,11 +105,11 @@ func aggregate(inputFile string) (map[string]*Aggregation, error) {
 
 		name := string(bName)
 
-		valX10, err := evaluateValX10(bVal)
+		valX10, err := parse(bVal)
 		if err != nil {
 			return nil, fmt.Errorf("invalid value at line %v: %w", lineNum, err)
 		}
-		val := float64(valX10) / 10
+		val := float64(valX10) / divisor
 
 		a, ok := agg[name]
 		if !ok {
@@ -93,7 +132,7 @@ func aggregate(inputFile string) (map[string]*Aggregation, error) {
 	}
 
 	for _, a := range agg {
-		a.mean = float64(a.sumX10) / float64(a.count) / 10
+		a.mean = float64(a.sumX10) / float64(a.count) / divisor
 	}
 
 	return agg, nil
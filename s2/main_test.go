@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/reference"
+	"github.com/minhtri06/1brc/schema"
 	"github.com/minhtri06/1brc/writeresult"
 )
 
@@ -41,6 +48,87 @@ func TestAggregate(t *testing.T) {
 	}
 
 	if string(expected) != string(actual) {
-		t.Errorf("output mismatch\nExpected:\n%s\nActual:\n%s", expected, actual)
+		t.Errorf("output mismatch\n%s", writeresult.DiffOutputs(string(expected), string(actual)))
 	}
 }
+
+func TestAggregateSchema(t *testing.T) {
+	inputFile := filepath.Join(t.TempDir(), "input.tsv")
+	if err := os.WriteFile(inputFile, []byte("Abha\t+12.25\nAbha\t-3\nOslo\t0.5"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	sch := schema.Schema{Separator: '\t', Scale: 2, Signs: schema.SignMinus | schema.SignPlus}
+	agg, err := aggregateContext(context.Background(), inputFile, sch)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	expected := map[string]Aggregation{
+		"Abha": {min: -3, mean: 4.625, max: 12.25, count: 2, sumX10: 925},
+		"Oslo": {min: 0.5, mean: 0.5, max: 0.5, count: 1, sumX10: 50},
+	}
+	actual := map[string]Aggregation{}
+	for name, a := range agg {
+		actual[name] = *a
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// Unlike the challenge format, other schemas check the values
+	sch.Signs = schema.SignMinus
+	if _, err := aggregateContext(context.Background(), inputFile, sch); err == nil {
+		t.Error("expected an error for a leading plus")
+	}
+}
+
+func TestAggregateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := aggregateContext(ctx, "../measurements_small.txt", schema.Default); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	bench.Benchmark(b, "../measurements_small.txt", func(filename string) error {
+		_, err := aggregate(filename)
+		return err
+	})
+}
+
+func FuzzEvaluateValX10(f *testing.F) {
+	for _, seed := range []string{"12.3", "-4.5", "0.0", "-0.0", "99.9", "-99.9", "05.1", "1.23", "12", "123.4", "-", ".", "--1.0", "1.-2", ""} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, val []byte) {
+		valX10, err := evaluateValX10(val)
+		if !reference.IsChallengeValue(string(val)) {
+			return
+		}
+
+		_, expected, _ := reference.ParseLine("x;" + string(val))
+		if err != nil {
+			t.Fatalf("evaluateValX10(%q) failed: %v", val, err)
+		}
+		if valX10 != reference.ValX10(expected) {
+			t.Errorf("evaluateValX10(%q) = %v, expected %v", val, valX10, reference.ValX10(expected))
+		}
+	})
+}
+
+// TestDifferential runs the solution over random datasets and compares it with the strict parser of solution 1.
+func TestDifferential(t *testing.T) {
+	bench.Differential(t, 30, func(i int, rnd *rand.Rand, filename string) (map[string]string, error) {
+		agg, err := aggregate(filename)
+		if err != nil {
+			return nil, err
+		}
+		actual := map[string]string{}
+		for k, v := range agg {
+			actual[k] = reference.Line(v.min, v.mean, v.max, v.count)
+		}
+		return actual, nil
+	})
+}
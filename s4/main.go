@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"runtime/pprof"
+
+	"github.com/minhtri06/1brc/bench"
 )
 
 // A slightly improvement of solution 3, init the app with an initial capacity.
@@ -13,6 +16,9 @@ import (
 
 const inputFile = "../measurements.txt"
 
+// ctxCheckInterval is how many lines are read between two checks of the context.
+const ctxCheckInterval = 1 << 16
+
 type Aggregation struct {
 	min  float64
 	mean float64
@@ -23,6 +29,13 @@ type Aggregation struct {
 }
 
 func main() {
+	if bench.Requested() {
+		bench.Run(func(filename string) error {
+			_, err := aggregate(filename)
+			return err
+		})
+		return
+	}
 	f, err := os.Create("cpu.prof")
 	if err != nil {
 		panic(fmt.Errorf("cannot create prof file: %w", err))
@@ -41,6 +54,11 @@ func main() {
 }
 
 func aggregate(inputFile string) (map[string]*Aggregation, error) {
+	return aggregateContext(context.Background(), inputFile)
+}
+
+// aggregateContext is aggregate but gives up as soon as ctx is done.
+func aggregateContext(ctx context.Context, inputFile string) (map[string]*Aggregation, error) {
 	file, err := os.Open(inputFile)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file: %w", err)
@@ -53,6 +71,11 @@ func aggregate(inputFile string) (map[string]*Aggregation, error) {
 	lineNum := 0
 
 	for scanner.Scan() {
+		if lineNum%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("stopped after %v lines: %w", lineNum, err)
+			}
+		}
 		lineNum++
 		line := scanner.Bytes()
 
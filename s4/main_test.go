@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/reference"
 	"github.com/minhtri06/1brc/writeresult"
 )
 
@@ -41,6 +46,78 @@ func TestAggregate(t *testing.T) {
 	}
 
 	if string(expected) != string(actual) {
-		t.Errorf("output mismatch\nExpected:\n%s\nActual:\n%s", expected, actual)
+		t.Errorf("output mismatch\n%s", writeresult.DiffOutputs(string(expected), string(actual)))
 	}
 }
+
+func TestAggregateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := aggregateContext(ctx, "../measurements_small.txt"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	bench.Benchmark(b, "../measurements_small.txt", func(filename string) error {
+		_, err := aggregate(filename)
+		return err
+	})
+}
+
+func FuzzSeparateNameValue(f *testing.F) {
+	for _, seed := range []string{"Abha;12.3", "Abéché;-4.5", "A;0.0", "Ab;ha;1.0", ";1.0", "Abha;1.23", "Abha", "Abha;", ";", ""} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		name, value, found := separateNameValue(line)
+		if !reference.IsChallengeLine(string(line)) {
+			return
+		}
+
+		expectedName, expectedVal, _ := reference.ParseLine(string(line))
+		if !found || string(name) != expectedName {
+			t.Fatalf("separateNameValue(%q) = %q, %v, expected name %q", line, name, found, expectedName)
+		}
+		valX10, err := evaluateValX10(value)
+		if err != nil || valX10 != reference.ValX10(expectedVal) {
+			t.Errorf("separateNameValue(%q): value %q evaluates to %v (%v), expected %v", line, value, valX10, err, reference.ValX10(expectedVal))
+		}
+	})
+}
+
+func FuzzEvaluateValX10(f *testing.F) {
+	for _, seed := range []string{"12.3", "-4.5", "0.0", "-0.0", "99.9", "-99.9", "05.1", "1.23", "12", "123.4", "-", ".", "--1.0", "1.-2", ""} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, val []byte) {
+		valX10, err := evaluateValX10(val)
+		if !reference.IsChallengeValue(string(val)) {
+			return
+		}
+
+		_, expected, _ := reference.ParseLine("x;" + string(val))
+		if err != nil {
+			t.Fatalf("evaluateValX10(%q) failed: %v", val, err)
+		}
+		if valX10 != reference.ValX10(expected) {
+			t.Errorf("evaluateValX10(%q) = %v, expected %v", val, valX10, reference.ValX10(expected))
+		}
+	})
+}
+
+// TestDifferential runs the solution over random datasets and compares it with the strict parser of solution 1.
+func TestDifferential(t *testing.T) {
+	bench.Differential(t, 30, func(i int, rnd *rand.Rand, filename string) (map[string]string, error) {
+		agg, err := aggregate(filename)
+		if err != nil {
+			return nil, err
+		}
+		actual := map[string]string{}
+		for k, v := range agg {
+			actual[k] = reference.Line(v.min, v.mean, v.max, v.count)
+		}
+		return actual, nil
+	})
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"runtime/pprof"
+
+	"github.com/minhtri06/1brc/bench"
 )
 
 // This solution adds two improvements to solution 4:
@@ -16,7 +19,17 @@ import (
 
 const inputFile = "../measurements.txt"
 
+// ctxCheckInterval is how many lines are read between two checks of the context.
+const ctxCheckInterval = 1 << 16
+
 func main() {
+	if bench.Requested() {
+		bench.Run(func(filename string) error {
+			_, err := aggregate(filename)
+			return err
+		})
+		return
+	}
 	f, err := os.Create("cpu.prof")
 	if err != nil {
 		panic(fmt.Errorf("cannot create prof file: %w", err))
@@ -39,11 +52,16 @@ type Aggregation struct {
 	mean float64
 	max  float64
 
-	count  int32
-	sumX10 int
+	count  int64
+	sumX10 int64
 }
 
 func aggregate(inputFile string) (map[string]*Aggregation, error) {
+	return aggregateContext(context.Background(), inputFile)
+}
+
+// aggregateContext is aggregate but gives up as soon as ctx is done.
+func aggregateContext(ctx context.Context, inputFile string) (map[string]*Aggregation, error) {
 	file, err := os.Open(inputFile)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file: %w", err)
@@ -52,8 +70,15 @@ func aggregate(inputFile string) (map[string]*Aggregation, error) {
 
 	agg := make(map[string]*Aggregation, 1000)
 	scanner := bufio.NewScanner(file)
+	lineNum := 0
 
 	for scanner.Scan() {
+		if lineNum%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("stopped after %v lines: %w", lineNum, err)
+			}
+		}
+		lineNum++
 		line := scanner.Bytes()
 
 		name, valX10 := extractNameValueX10(line)
@@ -64,13 +89,13 @@ func aggregate(inputFile string) (map[string]*Aggregation, error) {
 			agg[string(name)] = &Aggregation{
 				min:    val,
 				max:    val,
-				sumX10: valX10,
+				sumX10: int64(valX10),
 				count:  1,
 			}
 		} else {
 			a.max = max(a.max, val)
 			a.min = min(a.min, val)
-			a.sumX10 += valX10
+			a.sumX10 += int64(valX10)
 			a.count++
 		}
 	}
@@ -62,8 +62,8 @@ func (m *customMap) set(key []byte, value *Aggregation) {
 			return
 		}
 
-		// Move to next bucket (linear probing)
-		bucket++
+		// Move to next bucket (linear probing), wrapping around at the end of the table
+		bucket = (bucket + 1) & mapMask
 	}
 }
 
@@ -83,8 +83,8 @@ func (m *customMap) get(key []byte) (*Aggregation, bool) {
 			return entry.value, true
 		}
 
-		// Move to next bucket (linear probing)
-		bucket = bucket + 1
+		// Move to next bucket (linear probing), wrapping around at the end of the table
+		bucket = (bucket + 1) & mapMask
 	}
 }
 
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"runtime/pprof"
+
+	"github.com/minhtri06/1brc/bench"
 )
 
 // This solution uses a custom map implementation to aggregate measurements.
@@ -12,7 +15,17 @@ import (
 
 const inputFile = "../measurements.txt"
 
+// ctxCheckInterval is how many lines are read between two checks of the context.
+const ctxCheckInterval = 1 << 16
+
 func main() {
+	if bench.Requested() {
+		bench.Run(func(filename string) error {
+			_, err := aggregate(filename)
+			return err
+		})
+		return
+	}
 	f, err := os.Create("cpu.prof")
 	if err != nil {
 		panic(fmt.Errorf("cannot create prof file: %w", err))
@@ -35,11 +48,16 @@ type Aggregation struct {
 	mean float64
 	max  float64
 
-	count  int32
-	sumX10 int
+	count  int64
+	sumX10 int64
 }
 
 func aggregate(inputFile string) (*customMap, error) {
+	return aggregateContext(context.Background(), inputFile)
+}
+
+// aggregateContext is aggregate but gives up as soon as ctx is done.
+func aggregateContext(ctx context.Context, inputFile string) (*customMap, error) {
 	file, err := os.Open(inputFile)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file: %w", err)
@@ -48,8 +66,15 @@ func aggregate(inputFile string) (*customMap, error) {
 
 	agg := newCustomMap()
 	scanner := bufio.NewScanner(file)
+	lineNum := 0
 
 	for scanner.Scan() {
+		if lineNum%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("stopped after %v lines: %w", lineNum, err)
+			}
+		}
+		lineNum++
 		line := scanner.Bytes()
 
 		name, valX10 := extractNameValueX10(line)
@@ -62,14 +87,14 @@ func aggregate(inputFile string) (*customMap, error) {
 				&Aggregation{
 					min:    val,
 					max:    val,
-					sumX10: valX10,
+					sumX10: int64(valX10),
 					count:  1,
 				},
 			)
 		} else {
 			a.max = max(a.max, val)
 			a.min = min(a.min, val)
-			a.sumX10 += valX10
+			a.sumX10 += int64(valX10)
 			a.count++
 		}
 	}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/reference"
 	"github.com/minhtri06/1brc/writeresult"
 )
 
@@ -41,6 +47,90 @@ func TestAggregate(t *testing.T) {
 	}
 
 	if string(expected) != string(actual) {
-		t.Errorf("output mismatch\nExpected:\n%s\nActual:\n%s", expected, actual)
+		t.Errorf("output mismatch\n%s", writeresult.DiffOutputs(string(expected), string(actual)))
+	}
+}
+
+func TestAggregateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := aggregateContext(ctx, "../measurements_small.txt"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	bench.Benchmark(b, "../measurements_small.txt", func(filename string) error {
+		_, err := aggregate(filename)
+		return err
+	})
+}
+
+func TestCustomMapWraps(t *testing.T) {
+	// Both names hash to the last bucket, the second one must wrap around to the first
+	m := newCustomMap()
+	names := []string{"S189199", "S255263"}
+	for i, name := range names {
+		m.set([]byte(name), &Aggregation{count: int64(i + 1)})
+	}
+	for i, name := range names {
+		if a, ok := m.get([]byte(name)); !ok || a.count != int64(i+1) {
+			t.Errorf("get(%q) = %+v, %v, expected a count of %d", name, a, ok, i+1)
+		}
+	}
+}
+
+func FuzzExtractNameValueX10(f *testing.F) {
+	for _, seed := range []string{"Abha;12.3", "Abéché;-4.5", "A;0.0", "Ab;ha;1.0", ";1.0", "Abha;1.23", "Abha", "Abha;", ";", ""} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		name, valX10 := extractNameValueX10(line)
+		if !reference.IsChallengeLine(string(line)) {
+			return
+		}
+
+		expectedName, expectedVal, _ := reference.ParseLine(string(line))
+		if string(name) != expectedName || int64(valX10) != reference.ValX10(expectedVal) {
+			t.Errorf("extractNameValueX10(%q) = %q, %v, expected %q, %v", line, name, valX10, expectedName, reference.ValX10(expectedVal))
+		}
+	})
+}
+
+// TestDifferential runs the solution over random datasets and compares it with the strict parser of solution 1.
+func TestDifferential(t *testing.T) {
+	bench.Differential(t, 30, func(i int, rnd *rand.Rand, filename string) (map[string]string, error) {
+		agg, err := aggregate(filename)
+		if err != nil {
+			return nil, err
+		}
+		actual := map[string]string{}
+		for k, v := range agg.toMap() {
+			actual[k] = reference.Line(v.min, v.mean, v.max, v.count)
+		}
+		return actual, nil
+	})
+}
+
+func TestHugeSums(t *testing.T) {
+	// 2.2 million rows of 99.9 sum to more than 2^31 tenths, which overflowed the int sum on 32-bit platforms.
+	// Counts have the same 64-bit type, but 2^31 rows are too many for a test.
+	const rows = 2_200_000
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, bytes.Repeat([]byte("Abha;99.9\n"), rows), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	agg, err := aggregate(inputFile)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	a := agg.toMap()["Abha"]
+	if a == nil || a.sumX10 != rows*999 {
+		t.Fatalf("got %+v, expected %d rows summing to %d", a, rows, int64(rows*999))
+	}
+	if got, want := reference.Line(a.min, a.mean, a.max, a.count), reference.Line(99.9, 99.9, 99.9, rows); got != want {
+		t.Errorf("got %s, expected %s", got, want)
 	}
 }
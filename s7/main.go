@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"runtime/pprof"
+
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/schema"
 )
 
 // In this solution, we remove the bufio.Scanner and native map and combine the logic of them
@@ -16,16 +21,21 @@ import (
 // 2. Second, we traverse the line again to process the name and value.
 //
 // And with this solution, we only traverse the line once.
-// Also, it assumes the input file to be valid and contains less than 10,000 distinct station names.
+// Also, it assumes the input file to be valid and contains less than 10,000 distinct station names,
+// only the position of the decimal point is checked so a value of another scale isn't read wrong.
+// Other layouts than the challenge one go through schema.Schema.ParseValue, which does check the values.
 
 const (
 	inputFile = "../measurements.txt"
-	bufSize   = 1024 * 1024 // 1 MB buffer size
+	bufSize   = 1024 * 1024 // 1 MB buffer size, grown for longer lines
 	mapSize   = 131072      // 2^17, power of two
 	mapMask   = mapSize - 1
 	maxLoad   = mapSize / 2 // panic if more than half full, we know there's no more 10k station names
 	fnvOffset = 14695981039346656037
 	fnvPrime  = 1099511628211
+
+	maxScanBufSize = 64 * 1024 * 1024 // lines longer than this are an error
+	maxZeroReads   = 100              // consecutive empty reads before giving up, like bufio
 )
 
 type Aggregation struct {
@@ -33,8 +43,8 @@ type Aggregation struct {
 	Mean float64
 	Max  float64
 
-	count  int32
-	sumX10 int
+	count  int64
+	sumX10 int64
 }
 
 type Entry struct {
@@ -43,6 +53,13 @@ type Entry struct {
 }
 
 func main() {
+	if bench.Requested() {
+		bench.Run(func(filename string) error {
+			_, err := aggregate(filename)
+			return err
+		})
+		return
+	}
 	f, err := os.Create("cpu.prof")
 	if err != nil {
 		panic(fmt.Errorf("cannot create prof file: %w", err))
@@ -61,12 +78,33 @@ func main() {
 }
 
 func aggregate(inputFile string) ([]*Entry, error) {
+	return aggregateContext(context.Background(), inputFile, schema.Default)
+}
+
+// aggregateContext is aggregate for files laid out as sch, it gives up as soon as ctx is done, it's checked once per buffer.
+// Only single-column schemas without timestamps are supported.
+func aggregateContext(ctx context.Context, inputFile string, sch schema.Schema) ([]*Entry, error) {
 	file, err := os.Open(inputFile)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file: %w", err)
 	}
 	defer file.Close()
 
+	return aggregateReader(ctx, file, sch)
+}
+
+// aggregateReader is aggregateContext for any reader, which may return fewer bytes than asked for.
+func aggregateReader(ctx context.Context, r io.Reader, sch schema.Schema) ([]*Entry, error) {
+	if err := sch.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if sch.NumColumns() > 1 || sch.Time != schema.TimeNone {
+		return nil, errors.New("only schemas with a single value column and no timestamp are supported")
+	}
+	generic := !sch.IsDefault()
+	sep := sch.Separator
+	divisor := sch.Divisor()
+
 	// Custom map
 	m := make([]*Entry, mapSize)
 	size := 0
@@ -74,53 +112,101 @@ func aggregate(inputFile string) ([]*Entry, error) {
 	buf := make([]byte, bufSize)
 	readStart := 0
 	done := false
+	zeroReads := 0
 
 	for !done {
-		n, err := file.Read(buf[readStart:])
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if readStart == len(buf) {
+			// The buffer is full without a single newline, grow it to fit the line
+			if len(buf) >= maxScanBufSize {
+				return nil, fmt.Errorf("line longer than %d bytes", maxScanBufSize)
+			}
+			buf = append(buf, make([]byte, len(buf))...)
+		}
+
+		n, err := r.Read(buf[readStart:])
 		if err != nil {
 			if err != io.EOF {
 				return nil, fmt.Errorf("failed to read file: %w", err)
 			}
 			done = true
 		}
+		if n == 0 && !done {
+			// Readers may return nothing without an error, but not forever
+			zeroReads++
+			if zeroReads >= maxZeroReads {
+				return nil, io.ErrNoProgress
+			}
+			continue
+		}
+		zeroReads = 0
 		length := readStart + n
 
-		// According the the spec, we know the length of each line is no longer than 1 MB.
-		chunk := buf[:bytes.LastIndexByte(buf[:length], '\n')+1] // Include the newline character
+		// Terminate a last line that has no newline, so it's not dropped
+		if done && length > 0 && buf[length-1] != '\n' {
+			if length == len(buf) {
+				buf = append(buf, '\n')
+			}
+			buf[length] = '\n'
+			length++
+		}
 
+		chunk := buf[:bytes.LastIndexByte(buf[:length], '\n')+1] // Include the newline character
 		for i := 0; i < len(chunk); {
 			// Find the station name and calculate the hash on the way
 			hash := uint64(fnvOffset)
 			start := i
-			for ; chunk[i] != ';'; i++ {
+			for ; chunk[i] != sep; i++ {
+				if chunk[i] == '\n' {
+					// Without this check we'd run past the end of the chunk
+					return nil, fmt.Errorf("missing separator in line %q", chunk[start:i])
+				}
 				hash ^= uint64(chunk[i])
 				hash *= uint64(fnvPrime)
 			}
 			name := chunk[start:i]
 			i++ // Skip the newline character
 
-			// Calculate the value
-			valX10 := 0
-			negative := false
-			for ; chunk[i] != '\n'; i++ {
-				if chunk[i] == '-' {
-					negative = true
-					continue
+			// Calculate the value, multiplied by 10^Scale with another schema than the challenge one
+			var valX10 int64
+			if generic {
+				end := i + bytes.IndexByte(chunk[i:], '\n')
+				v, err := sch.ParseValue(chunk[i:end])
+				if err != nil {
+					return nil, fmt.Errorf("station %q: %w", name, err)
 				}
-				if chunk[i] == '.' {
-					continue
+				valX10 = v
+				i = end
+			} else {
+				valStart := i
+				negative := false
+				for ; chunk[i] != '\n'; i++ {
+					if chunk[i] == '-' {
+						negative = true
+						continue
+					}
+					if chunk[i] == '.' {
+						continue
+					}
+					valX10 = valX10*10 + int64(chunk[i]-'0')
+				}
+				if i-valStart < 3 || chunk[i-2] != '.' {
+					// Any other scale would be read wrong, "1.23" as 12.3
+					return nil, fmt.Errorf("station %q: invalid value %q, expected exactly one fractional digit", name, chunk[valStart:i])
+				}
+				if negative {
+					valX10 = -valX10
 				}
-				valX10 = valX10*10 + int(chunk[i]-'0')
 			}
 			i++ // Skip the newline character
-			if negative {
-				valX10 = -valX10
-			}
-			val := float64(valX10) / 10
+			val := float64(valX10) / divisor
 
 			// Set value into the map
 			bucket := hash & mapMask
-			for ; ; bucket++ {
+			for ; ; bucket = (bucket + 1) & mapMask {
 				e := m[bucket]
 				if e == nil {
 					// Empty slot, insert here
@@ -155,7 +241,7 @@ func aggregate(inputFile string) ([]*Entry, error) {
 		if e == nil {
 			continue
 		}
-		e.value.Mean = float64(e.value.sumX10) / float64(e.value.count) / 10
+		e.value.Mean = float64(e.value.sumX10) / float64(e.value.count) / divisor
 		agg = append(agg, e)
 	}
 
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
 
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/reference"
+	"github.com/minhtri06/1brc/schema"
 	"github.com/minhtri06/1brc/writeresult"
 )
 
@@ -41,6 +52,244 @@ func TestAggregate(t *testing.T) {
 	}
 
 	if string(expected) != string(actual) {
-		t.Errorf("output mismatch\nExpected:\n%s\nActual:\n%s", expected, actual)
+		t.Errorf("output mismatch\n%s", writeresult.DiffOutputs(string(expected), string(actual)))
+	}
+}
+
+func TestAggregateLongLines(t *testing.T) {
+	long := strings.Repeat("A", 3*bufSize)
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	// Lines longer than the buffer, and no trailing newline either
+	if err := os.WriteFile(inputFile, []byte("Abha;12.3\n"+long+";-1.0\nAbha;1.0"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	agg, err := aggregate(inputFile)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"Abha": reference.Line(1.0, 6.7, 12.3, 2),
+		long:   reference.Line(-1.0, -1.0, -1.0, 1),
+	}
+	actual := map[string]string{}
+	for _, e := range agg {
+		actual[string(e.name)] = reference.Line(e.value.Min, e.value.Mean, e.value.Max, e.value.count)
+	}
+	if diff := reference.Diff(expected, actual); diff != "" {
+		t.Errorf("result mismatch\n%s", diff)
+	}
+}
+
+func TestAggregateReaders(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"OneByteReader": iotest.OneByteReader,
+		"HalfReader":    iotest.HalfReader,
+		"DataErrReader": iotest.DataErrReader,
+		"emptyReads":    func(r io.Reader) io.Reader { return &emptyReadsReader{r: r} },
+	}
+	for name, wrap := range readers {
+		t.Run(name, func(t *testing.T) {
+			entries, err := aggregateReader(context.Background(), wrap(bytes.NewReader(input)), schema.Default)
+			if err != nil {
+				t.Fatalf("aggregate failed: %v", err)
+			}
+			checkAgainstReference(t, input, entries)
+		})
+	}
+}
+
+func TestAggregateReadError(t *testing.T) {
+	_, err := aggregateReader(context.Background(), iotest.TimeoutReader(strings.NewReader("Abha;12.3\nAbha;1.0\n")), schema.Default)
+	if !errors.Is(err, iotest.ErrTimeout) {
+		t.Errorf("expected iotest.ErrTimeout, got %v", err)
+	}
+
+	_, err = aggregateReader(context.Background(), &emptyReadsReader{r: strings.NewReader("Abha;12.3\n"), always: true}, schema.Default)
+	if !errors.Is(err, io.ErrNoProgress) {
+		t.Errorf("expected io.ErrNoProgress, got %v", err)
+	}
+}
+
+// emptyReadsReader returns 0, nil before every read of r, or always when set.
+type emptyReadsReader struct {
+	r      io.Reader
+	always bool
+	empty  bool
+}
+
+func (e *emptyReadsReader) Read(p []byte) (int, error) {
+	e.empty = !e.empty
+	if e.empty || e.always {
+		return 0, nil
+	}
+	return e.r.Read(p)
+}
+
+func TestAggregateSchema(t *testing.T) {
+	inputFile := filepath.Join(t.TempDir(), "input.tsv")
+	if err := os.WriteFile(inputFile, []byte("Abha\t+12.25\nAbha\t-3\nOslo\t0.5"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	sch := schema.Schema{Separator: '\t', Scale: 2, Signs: schema.SignMinus | schema.SignPlus}
+	agg, err := aggregateContext(context.Background(), inputFile, sch)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	expected := map[string]Aggregation{
+		"Abha": {Min: -3, Mean: 4.625, Max: 12.25, count: 2, sumX10: 925},
+		"Oslo": {Min: 0.5, Mean: 0.5, Max: 0.5, count: 1, sumX10: 50},
+	}
+	actual := map[string]Aggregation{}
+	for _, e := range agg {
+		actual[string(e.name)] = *e.value
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// Unlike the challenge format, other schemas check the values
+	sch.Signs = schema.SignMinus
+	if _, err := aggregateContext(context.Background(), inputFile, sch); err == nil {
+		t.Error("expected an error for a leading plus")
+	}
+
+	// The challenge format only checks the decimal point, so a value of another scale isn't read wrong
+	if err := os.WriteFile(inputFile, []byte("Abha;1.23\n"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	if _, err := aggregate(inputFile); err == nil {
+		t.Error("expected an error for two fractional digits")
+	}
+}
+
+func TestAggregateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := aggregateContext(ctx, "../measurements_small.txt", schema.Default); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	bench.Benchmark(b, "../measurements_small.txt", func(filename string) error {
+		_, err := aggregate(filename)
+		return err
+	})
+}
+
+func FuzzAggregate(f *testing.F) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		f.Fatalf("failed to read input: %v", err)
+	}
+	f.Add(input)
+	for _, seed := range []string{"", "Abha;12.3\n", "Abha;12.3", "Abha\n", "\n", ";\n", "Ab;ha;1.0\n", "Abha;1.23\nAbha;-0.0\n"} {
+		f.Add([]byte(seed))
+	}
+	// Both names hash to the last bucket, the second one must wrap around to the first
+	f.Add([]byte("S189199;1.0\nS255263;2.0\nS189199;3.0\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		inputFile := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(inputFile, data, 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+
+		entries, err := aggregate(inputFile)
+		if !isChallengeInput(data) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("aggregate failed: %v", err)
+		}
+		checkAgainstReference(t, data, entries)
+	})
+}
+
+// isChallengeInput reports whether every line of data follows the rules of the challenge.
+func isChallengeInput(data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+	if data[len(data)-1] != '\n' {
+		return false
+	}
+	for _, line := range strings.Split(string(data[:len(data)-1]), "\n") {
+		if !reference.IsChallengeLine(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAgainstReference compares entries with what the strict parser of solution 1 gives for data.
+func checkAgainstReference(t *testing.T, data []byte, entries []*Entry) {
+	t.Helper()
+
+	expected, err := reference.Aggregate(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("reference aggregate failed: %v", err)
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("got %d stations, expected %d", len(entries), len(expected))
+	}
+	for _, e := range entries {
+		s, ok := expected[string(e.name)]
+		if !ok {
+			t.Fatalf("unexpected station %q", e.name)
+		}
+		if e.value.Min != s.Min || e.value.Max != s.Max || e.value.sumX10 != s.SumX10 || e.value.count != s.Count {
+			t.Errorf("station %q: got %+v, expected %+v", e.name, *e.value, *s)
+		}
+	}
+}
+
+// TestDifferential runs the solution over random datasets and compares it with the strict parser of solution 1.
+func TestDifferential(t *testing.T) {
+	bench.Differential(t, 30, func(i int, rnd *rand.Rand, filename string) (map[string]string, error) {
+		agg, err := aggregate(filename)
+		if err != nil {
+			return nil, err
+		}
+		actual := map[string]string{}
+		for _, e := range agg {
+			actual[string(e.name)] = reference.Line(e.value.Min, e.value.Mean, e.value.Max, e.value.count)
+		}
+		return actual, nil
+	})
+}
+
+func TestHugeSums(t *testing.T) {
+	// 2.2 million rows of 99.9 sum to more than 2^31 tenths, which overflowed the int sum on 32-bit platforms.
+	// Counts have the same 64-bit type, but 2^31 rows are too many for a test.
+	const rows = 2_200_000
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, bytes.Repeat([]byte("Abha;99.9\n"), rows), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	agg, err := aggregate(inputFile)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	var a *Aggregation
+	for _, e := range agg {
+		if string(e.name) == "Abha" {
+			a = e.value
+		}
+	}
+	if a == nil || a.sumX10 != rows*999 {
+		t.Fatalf("got %+v, expected %d rows summing to %d", a, rows, int64(rows*999))
+	}
+	if got, want := reference.Line(a.Min, a.Mean, a.Max, a.count), reference.Line(99.9, 99.9, 99.9, rows); got != want {
+		t.Errorf("got %s, expected %s", got, want)
 	}
 }
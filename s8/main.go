@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"sync"
+
+	"github.com/minhtri06/1brc/bench"
 )
 
 // This solution add parallelism to the solution 2, which I think is the balance between efficient and simple.
@@ -26,7 +29,17 @@ type Aggregation struct {
 
 const inputFile = "../measurements.txt"
 
+// ctxCheckInterval is how many lines a worker reads between two checks of the context.
+const ctxCheckInterval = 1 << 16
+
 func main() {
+	if bench.Requested() {
+		bench.Run(func(filename string) error {
+			_, err := Aggregate(filename)
+			return err
+		})
+		return
+	}
 	f, err := os.Create("cpu.prof")
 	if err != nil {
 		panic(fmt.Errorf("cannot create prof file: %w", err))
@@ -45,22 +58,35 @@ func main() {
 }
 
 func Aggregate(inputFile string) (map[string]*Aggregation, error) {
-	file, err := os.Open(inputFile)
-	if err != nil {
-		return nil, fmt.Errorf("cannot open file: %w", err)
-	}
-	defer file.Close()
+	return AggregateContext(context.Background(), inputFile)
+}
 
+// AggregateContext is Aggregate but stops every worker as soon as ctx is done or one of them fails.
+// The returned error tells which part failed.
+func AggregateContext(ctx context.Context, inputFile string) (map[string]*Aggregation, error) {
 	numWorkers := runtime.NumCPU()
 	if numWorkers < 1 {
 		numWorkers = 16
 	}
+	return aggregateWorkers(ctx, inputFile, numWorkers)
+}
+
+// aggregateWorkers splits the file into numWorkers parts and reads them concurrently.
+func aggregateWorkers(ctx context.Context, inputFile string, numWorkers int) (map[string]*Aggregation, error) {
+	file, err := os.Open(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %w", err)
+	}
+	defer file.Close()
 
 	fileParts, err := splitsFile(inputFile, numWorkers)
 	if err != nil {
 		return nil, fmt.Errorf("cannot split file: %w", err)
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	type result struct {
 		agg map[string]*Aggregation
 		err error
@@ -72,42 +98,44 @@ func Aggregate(inputFile string) (map[string]*Aggregation, error) {
 
 		var wg sync.WaitGroup
 
-		for _, part := range fileParts {
+		for i, part := range fileParts {
 			r := io.NewSectionReader(file, part.offset, part.length)
 
 			wg.Add(1)
-			go func(r io.Reader) {
+			go func(i int, part FilePart, r io.Reader) {
 				defer wg.Done()
 
-				agg, err := aggregate(r)
+				agg, err := aggregate(ctx, r)
 				if err != nil {
-					resCh <- &result{nil, fmt.Errorf("failed to aggregate: %w", err)}
+					resCh <- &result{nil, fmt.Errorf("failed to aggregate part %d (offset %d, length %d): %w", i, part.offset, part.length, err)}
 					return
 				}
 				resCh <- &result{agg, nil}
-			}(r)
+			}(i, part, r)
 		}
 
 		wg.Wait()
 	}()
 
 	agg := make(map[string]*Aggregation, 10000)
+	var firstErr error
 	for res := range resCh {
+		// Keep draining after an error so every worker is done with the file before it gets closed
+		if firstErr != nil {
+			continue
+		}
 		if res.err != nil {
-			return nil, res.err
+			firstErr = res.err
+			cancel()
+			continue
 		}
 		for k, v := range res.agg {
-			a, ok := agg[k]
-			if !ok {
-				agg[k] = v
-			} else {
-				a.min = min(a.min, v.min)
-				a.max = max(a.max, v.max)
-				a.sumX10 += v.sumX10
-				a.count += v.count
-			}
+			mergeInto(agg, k, v)
 		}
 	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
 
 	for _, a := range agg {
 		a.mean = float64(a.sumX10) / float64(a.count) / 10
@@ -116,11 +144,31 @@ func Aggregate(inputFile string) (map[string]*Aggregation, error) {
 	return agg, nil
 }
 
-func aggregate(r io.Reader) (map[string]*Aggregation, error) {
+// mergeInto merges the aggregation v of a worker into agg, which keeps v if it has no station name yet.
+func mergeInto(agg map[string]*Aggregation, name string, v *Aggregation) {
+	a, ok := agg[name]
+	if !ok {
+		agg[name] = v
+		return
+	}
+	a.min = min(a.min, v.min)
+	a.max = max(a.max, v.max)
+	a.sumX10 += v.sumX10
+	a.count += v.count
+}
+
+func aggregate(ctx context.Context, r io.Reader) (map[string]*Aggregation, error) {
 	agg := map[string]*Aggregation{}
 	scanner := bufio.NewScanner(r)
+	lineNum := 0
 
 	for scanner.Scan() {
+		if lineNum%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("stopped after %v lines: %w", lineNum, err)
+			}
+		}
+		lineNum++
 		line := scanner.Bytes()
 
 		newlineIdx := bytes.IndexByte(line, ';')
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/reference"
 	"github.com/minhtri06/1brc/writeresult"
 )
 
@@ -41,6 +47,120 @@ func TestAggregate(t *testing.T) {
 	}
 
 	if string(expected) != string(actual) {
-		t.Errorf("output mismatch\nExpected:\n%s\nActual:\n%s", expected, actual)
+		t.Errorf("output mismatch\n%s", writeresult.DiffOutputs(string(expected), string(actual)))
+	}
+}
+
+func TestAggregateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := AggregateContext(ctx, "../measurements_small.txt")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "part") {
+		t.Errorf("expected the error to identify the failed part, got %v", err)
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	bench.Benchmark(b, "../measurements_small.txt", func(filename string) error {
+		_, err := Aggregate(filename)
+		return err
+	})
+}
+
+func FuzzEvaluateValX10(f *testing.F) {
+	for _, seed := range []string{"12.3", "-4.5", "0.0", "-0.0", "99.9", "-99.9", "05.1", "1.23", "12", "123.4", "-", ".", "--1.0", "1.-2", ""} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, val []byte) {
+		valX10, err := evaluateValX10(val)
+		if !reference.IsChallengeValue(string(val)) {
+			return
+		}
+
+		_, expected, _ := reference.ParseLine("x;" + string(val))
+		if err != nil {
+			t.Fatalf("evaluateValX10(%q) failed: %v", val, err)
+		}
+		if valX10 != reference.ValX10(expected) {
+			t.Errorf("evaluateValX10(%q) = %v, expected %v", val, valX10, reference.ValX10(expected))
+		}
+	})
+}
+
+func FuzzSplitsFile(f *testing.F) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		f.Fatalf("failed to read input: %v", err)
+	}
+	f.Add(input, uint16(8))
+	f.Add(input, uint16(5000))
+	f.Add([]byte(""), uint16(4))
+	f.Add([]byte("no newline at all"), uint16(3))
+	f.Add([]byte("a;1.0\n\n\nb;2.0"), uint16(100))
+
+	f.Fuzz(func(t *testing.T, data []byte, numParts uint16) {
+		if numParts == 0 {
+			return
+		}
+		inputFile := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(inputFile, data, 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+
+		parts, err := splitsFile(inputFile, int(numParts))
+		if err != nil {
+			t.Fatalf("splitsFile failed: %v", err)
+		}
+		if len(parts) > int(numParts) {
+			t.Fatalf("got %d parts, asked for %d", len(parts), numParts)
+		}
+
+		// The parts must tile the file, and every part but the last must end on a newline
+		offset := int64(0)
+		for i, part := range parts {
+			if part.offset != offset || part.length <= 0 {
+				t.Fatalf("part %d %+v does not continue at offset %d", i, part, offset)
+			}
+			offset += part.length
+			if i < len(parts)-1 && data[offset-1] != '\n' {
+				t.Fatalf("part %d %+v does not end on a newline", i, part)
+			}
+		}
+		if offset != int64(len(data)) {
+			t.Errorf("parts cover %d bytes, expected %d", offset, len(data))
+		}
+	})
+}
+
+// TestDifferential runs the solution with 1 to 64 workers over random datasets and compares it with the strict parser of solution 1.
+func TestDifferential(t *testing.T) {
+	bench.Differential(t, 64, func(i int, rnd *rand.Rand, filename string) (map[string]string, error) {
+		agg, err := aggregateWorkers(context.Background(), filename, i+1)
+		if err != nil {
+			return nil, err
+		}
+		actual := map[string]string{}
+		for k, v := range agg {
+			actual[k] = reference.Line(v.min, v.mean, v.max, v.count)
+		}
+		return actual, nil
+	})
+}
+
+func TestHugeCounts(t *testing.T) {
+	// Two workers with 3 billion rows of 99.9 each, the merged count and sum don't fit in 32 bits on any platform
+	const rows = 3e9
+	agg := map[string]*Aggregation{}
+	for range 2 {
+		mergeInto(agg, "Abha", &Aggregation{min: 99.9, max: 99.9, sumX10: rows * 999, count: rows})
+	}
+	a := agg["Abha"]
+	a.mean = float64(a.sumX10) / float64(a.count) / 10
+	if a.count != 2*rows || a.sumX10 != 2*rows*999 || reference.Line(a.min, a.mean, a.max, a.count) != reference.Line(99.9, 99.9, 99.9, 2*rows) {
+		t.Errorf("got %d rows summing to %d with a mean of %v, expected %v rows of 99.9", a.count, a.sumX10, a.mean, 2*rows)
 	}
 }
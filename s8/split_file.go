@@ -41,7 +41,9 @@ func splitsFile(filename string, numParts int) ([]FilePart, error) {
 			break
 		}
 
-		end := offset + partSize - bufSize
+		// Never seek before the current offset, it happens when the file is smaller than numParts * bufSize,
+		// nor past the end of the file, it happens when the previous part ran to the end looking for a newline.
+		end := min(size, max(offset, offset+partSize-bufSize))
 		if _, err := file.Seek(end, io.SeekStart); err != nil {
 			return nil, fmt.Errorf("failed to seek file: %w", err)
 		}
@@ -63,6 +65,10 @@ func splitsFile(filename string, numParts int) ([]FilePart, error) {
 			end += int64(n)
 		}
 
+		if end == offset {
+			// Nothing left to split
+			break
+		}
 		parts = append(parts, FilePart{offset, end - offset})
 		offset = end
 	}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/minhtri06/1brc/schema"
+)
+
+// AnomalyOptions tells DetectAnomalies which rows to flag, a row is flagged as soon as one of them does.
+type AnomalyOptions struct {
+	// K, if above 0, flags values more than K standard deviations away from the mean of their station.
+	K float64
+	// Lower and Upper, if set, flag values below the Lower or above the Upper percentile of their station (0 to 100).
+	Lower *float64
+	Upper *float64
+}
+
+// StationStats are the statistics of the first pass the rows of a station are compared with.
+type StationStats struct {
+	Count  int64
+	Mean   float64
+	Stddev float64 // of the population
+	Lower  float64 // value of the Lower percentile, NaN without it
+	Upper  float64 // value of the Upper percentile, NaN without it
+}
+
+type Anomaly struct {
+	Station string
+	Value   float64
+	Offset  int64 // of the first byte of the line in the file
+	Line    int64 // starting at 1
+	// Deviation is the distance to the mean of the station in standard deviations, 0 when all its values are equal.
+	Deviation float64
+}
+
+// DetectAnomalies reads filename twice: the first pass computes the statistics of every station, the second one
+// flags the rows aopts tells apart from their station. Both passes cut the file in chunks for workers like
+// AggregateContext, the second one shares the statistics between workers without copying them.
+// Anomalies are in the order of the file. The schema must have a single value column and no timestamp,
+// and opts can have neither a Window nor a Filter.
+func DetectAnomalies(ctx context.Context, filename string, opts Options, aopts AnomalyOptions) ([]Anomaly, map[string]*StationStats, error) {
+	sch, err := opts.schema()
+	if err != nil {
+		return nil, nil, err
+	}
+	if sch.NumColumns() > 1 || sch.Time != schema.TimeNone || opts.Window != WindowNone || opts.Filter != nil {
+		return nil, nil, errors.New("anomalies need a single value column, and support neither timestamps nor filters")
+	}
+	if err := aopts.validate(); err != nil {
+		return nil, nil, err
+	}
+	format, err := opts.lines(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if format.Quotes {
+		return nil, nil, errors.New("anomalies don't support quoted names")
+	}
+
+	// First pass, the moments of every station and with percentiles the count of each of its values
+	percentiles := aopts.Lower != nil || aopts.Upper != nil
+	stations := make(map[string]*moments, 10000)
+	newStatsWorker := func() *statsWorker {
+		return &statsWorker{buf: make([]byte, scanBufSize), schema: sch, histograms: percentiles, stations: make(map[string]*moments)}
+	}
+	work := func(ctx context.Context, w *statsWorker, _ int, part FilePart, r io.Reader, counter *partCounter) error {
+		r, _, err := openPart(r, part, opts.Encoding, counter)
+		if err != nil {
+			return err
+		}
+		return scanLines(ctx, r, &w.buf, counter, w.process)
+	}
+	err = runChunks(ctx, filename, opts, newStatsWorker, work, func(w *statsWorker) {
+		for name, m := range w.stations {
+			if s, ok := stations[name]; ok {
+				s.merge(m)
+			} else {
+				stations[name] = m
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stats := make(map[string]*StationStats, len(stations))
+	limits := make(map[string]*anomalyLimits, len(stations))
+	for name, m := range stations {
+		stats[name], limits[name] = m.limits(aopts, sch.Divisor())
+	}
+
+	// Second pass, every worker reads limits but none writes to it
+	var chunks []*chunkAnomalies
+	newAnomalyWorker := func() *anomalyWorker {
+		return &anomalyWorker{buf: make([]byte, scanBufSize), schema: sch, limits: limits}
+	}
+	detect := func(ctx context.Context, w *anomalyWorker, i int, part FilePart, r io.Reader, counter *partCounter) error {
+		r, skipped, err := openPart(r, part, opts.Encoding, counter)
+		if err != nil {
+			return err
+		}
+		w.chunk = &chunkAnomalies{index: i, offset: part.offset + skipped}
+		w.chunks = append(w.chunks, w.chunk)
+		return scanLines(ctx, r, &w.buf, counter, w.process)
+	}
+	err = runChunks(ctx, filename, opts, newAnomalyWorker, detect, func(w *anomalyWorker) {
+		chunks = append(chunks, w.chunks...)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Workers only know the lines of their chunks, number them from the start of the file
+	slices.SortFunc(chunks, func(a, b *chunkAnomalies) int { return a.index - b.index })
+	var anomalies []Anomaly
+	lines := int64(0)
+	for _, c := range chunks {
+		for _, a := range c.anomalies {
+			a.Line += lines
+			anomalies = append(anomalies, a)
+		}
+		lines += c.lines
+	}
+	return anomalies, stats, nil
+}
+
+func (o AnomalyOptions) validate() error {
+	if o.K < 0 || math.IsNaN(o.K) {
+		return fmt.Errorf("invalid number of standard deviations %v", o.K)
+	}
+	for _, p := range []*float64{o.Lower, o.Upper} {
+		if p != nil && !(*p >= 0 && *p <= 100) {
+			return fmt.Errorf("invalid percentile %v, expected 0 to 100", *p)
+		}
+	}
+	if o.Lower != nil && o.Upper != nil && *o.Lower > *o.Upper {
+		return fmt.Errorf("lower percentile %v is above the upper one %v", *o.Lower, *o.Upper)
+	}
+	if o.K == 0 && o.Lower == nil && o.Upper == nil {
+		return errors.New("anomalies need a number of standard deviations or percentiles")
+	}
+	return nil
+}
+
+// moments are the statistics of a station in scaled values, updated with Welford's algorithm so the variance
+// doesn't lose its precision on billions of rows.
+type moments struct {
+	count int64
+	mean  float64
+	m2    float64 // sum of the squared distances to the mean
+
+	histogram map[int64]int64 // number of rows of each value, only for percentiles
+}
+
+func (m *moments) add(v int64) {
+	m.count++
+	d := float64(v) - m.mean
+	m.mean += d / float64(m.count)
+	m.m2 += d * (float64(v) - m.mean)
+	if m.histogram != nil {
+		m.histogram[v]++
+	}
+}
+
+// merge combines the moments of two sets of rows, see Chan et al.
+func (m *moments) merge(o *moments) {
+	count := m.count + o.count
+	d := o.mean - m.mean
+	m.mean += d * float64(o.count) / float64(count)
+	m.m2 += o.m2 + d*d*float64(m.count)*float64(o.count)/float64(count)
+	m.count = count
+	for v, n := range o.histogram {
+		m.histogram[v] += n
+	}
+}
+
+// percentile is the nearest-rank percentile p of the histogram.
+func (m *moments) percentile(p float64) int64 {
+	values := make([]int64, 0, len(m.histogram))
+	for v := range m.histogram {
+		values = append(values, v)
+	}
+	slices.Sort(values)
+
+	rank := max(1, int64(math.Ceil(p/100*float64(m.count))))
+	seen := int64(0)
+	for _, v := range values {
+		seen += m.histogram[v]
+		if seen >= rank {
+			return v
+		}
+	}
+	return values[len(values)-1]
+}
+
+// anomalyLimits flags the scaled values below min or above max.
+type anomalyLimits struct {
+	min, max     float64
+	mean, stddev float64
+}
+
+func (m *moments) limits(o AnomalyOptions, divisor float64) (*StationStats, *anomalyLimits) {
+	stddev := math.Sqrt(m.m2 / float64(m.count))
+	l := &anomalyLimits{min: math.Inf(-1), max: math.Inf(1), mean: m.mean, stddev: stddev}
+	s := &StationStats{Count: m.count, Mean: m.mean / divisor, Stddev: stddev / divisor, Lower: math.NaN(), Upper: math.NaN()}
+	if o.K > 0 {
+		l.min, l.max = m.mean-o.K*stddev, m.mean+o.K*stddev
+	}
+	if o.Lower != nil {
+		v := float64(m.percentile(*o.Lower))
+		l.min = max(l.min, v)
+		s.Lower = v / divisor
+	}
+	if o.Upper != nil {
+		v := float64(m.percentile(*o.Upper))
+		l.max = min(l.max, v)
+		s.Upper = v / divisor
+	}
+	return s, l
+}
+
+// parseRow splits a line without its newline character into the station name and the scaled value.
+// A "\r" ending the line is dropped, no value ends with one.
+func parseRow(line []byte, sch schema.Schema) ([]byte, int64, error) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	i := bytes.IndexByte(line, sch.Separator)
+	if i < 0 {
+		return nil, 0, fmt.Errorf("missing separator in line %q", line)
+	}
+	v, err := sch.ParseValue(line[i+1:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("line %q: %w", line, err)
+	}
+	return line[:i], v, nil
+}
+
+// statsWorker computes the moments of the stations in the chunks a worker of the first pass takes.
+type statsWorker struct {
+	buf        []byte
+	schema     schema.Schema
+	histograms bool
+	stations   map[string]*moments
+}
+
+func (w *statsWorker) process(chunk []byte) (int64, error) {
+	rows := int64(0)
+	for len(chunk) > 0 {
+		end := bytes.IndexByte(chunk, '\n')
+		name, v, err := parseRow(chunk[:end], w.schema)
+		if err != nil {
+			return 0, err
+		}
+		chunk = chunk[end+1:]
+		rows++
+
+		m, ok := w.stations[string(name)]
+		if !ok {
+			m = &moments{}
+			if w.histograms {
+				m.histogram = make(map[int64]int64)
+			}
+			w.stations[string(name)] = m
+		}
+		m.add(v)
+	}
+	return rows, nil
+}
+
+// chunkAnomalies are the anomalies of a chunk, numbered from the first line of the chunk.
+type chunkAnomalies struct {
+	index     int
+	offset    int64 // of the next line in the file
+	lines     int64
+	anomalies []Anomaly
+}
+
+type anomalyWorker struct {
+	buf    []byte
+	schema schema.Schema
+	limits map[string]*anomalyLimits // shared with every worker, read-only
+	chunk  *chunkAnomalies
+	chunks []*chunkAnomalies
+}
+
+func (w *anomalyWorker) process(chunk []byte) (int64, error) {
+	c := w.chunk
+	rows := int64(0)
+	for len(chunk) > 0 {
+		end := bytes.IndexByte(chunk, '\n')
+		name, v, err := parseRow(chunk[:end], w.schema)
+		if err != nil {
+			return 0, err
+		}
+		c.lines++
+		offset := c.offset
+		c.offset += int64(end) + 1
+		chunk = chunk[end+1:]
+		rows++
+
+		l, ok := w.limits[string(name)]
+		if !ok {
+			return 0, fmt.Errorf("station %q wasn't in the file on the first pass", name)
+		}
+		if x := float64(v); x < l.min || x > l.max {
+			deviation := 0.0
+			if l.stddev > 0 {
+				deviation = (x - l.mean) / l.stddev
+			}
+			c.anomalies = append(c.anomalies, Anomaly{
+				Station:   string(name),
+				Value:     x / w.schema.Divisor(),
+				Offset:    offset,
+				Line:      c.lines,
+				Deviation: deviation,
+			})
+		}
+	}
+	return rows, nil
+}
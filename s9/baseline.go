@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/minhtri06/1brc/writeresult"
+)
+
+// LoadBaseline reads a previous result to compare with: the output of run ("{Abha=-1.0/2.0/3.0, ...}"), or a JSON
+// snapshot of serve (GET /result?format=json or POST /snapshot). Counts are only known from snapshots.
+func LoadBaseline(filename string) (map[string]*Aggregation, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read baseline: %w", err)
+	}
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte("[")) {
+		var stats []stationStats
+		if err := json.Unmarshal(data, &stats); err != nil {
+			return nil, fmt.Errorf("cannot decode baseline snapshot: %w", err)
+		}
+		agg := make(map[string]*Aggregation, len(stats))
+		for _, s := range stats {
+			agg[s.Name] = &Aggregation{Min: s.Min, Mean: s.Mean, Max: s.Max, count: s.Count}
+		}
+		return agg, nil
+	}
+
+	res, err := writeresult.Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse baseline: %w", err)
+	}
+	agg := make(map[string]*Aggregation, len(res))
+	for name, s := range res {
+		agg[name] = &Aggregation{Min: s.Min, Mean: s.Mean, Max: s.Max}
+	}
+	return agg, nil
+}
+
+// StationDelta is the change of a station from the baseline, current minus baseline.
+type StationDelta struct {
+	Name string
+	Min  float64
+	Mean float64
+	Max  float64
+}
+
+// BaselineReport is the comparison of a result with a baseline.
+type BaselineReport struct {
+	// Deltas has the stations of both, by decreasing change of the mean in absolute value
+	Deltas []StationDelta
+	// New stations are only in the result, Gone ones only in the baseline, both sorted
+	New  []string
+	Gone []string
+}
+
+// CompareBaseline compares agg with baseline once both are rounded to decimals the way results are written, so a
+// result compared with its own output has no changes.
+func CompareBaseline(agg, baseline map[string]*Aggregation, decimals int) *BaselineReport {
+	round := func(v float64) float64 {
+		v, _ = strconv.ParseFloat(strconv.FormatFloat(v, 'f', decimals, 64), 64)
+		return v
+	}
+	delta := func(a, b float64) float64 {
+		return round(round(a) - round(b))
+	}
+
+	r := &BaselineReport{}
+	for name, a := range agg {
+		b, ok := baseline[name]
+		if !ok {
+			r.New = append(r.New, name)
+			continue
+		}
+		r.Deltas = append(r.Deltas, StationDelta{Name: name, Min: delta(a.Min, b.Min), Mean: delta(a.Mean, b.Mean), Max: delta(a.Max, b.Max)})
+	}
+	for name := range baseline {
+		if _, ok := agg[name]; !ok {
+			r.Gone = append(r.Gone, name)
+		}
+	}
+
+	slices.SortFunc(r.Deltas, func(a, b StationDelta) int {
+		return cmp.Or(cmp.Compare(math.Abs(b.Mean), math.Abs(a.Mean)), cmp.Compare(a.Name, b.Name))
+	})
+	slices.Sort(r.New)
+	slices.Sort(r.Gone)
+	return r
+}
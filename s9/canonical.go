@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Canonical turns the names of stations into canonical ones, so the spellings of a station are aggregated together.
+// Names go through the steps in the order of the fields. The map still compares names byte by byte, a new spelling
+// is canonicalized once when it's first inserted and its rows are merged with the others at the end.
+type Canonical struct {
+	Trim bool // drop leading and trailing white space
+	NFC  bool // Unicode normalization form C, "é" written as e followed by a combining accent becomes one code point
+	// Fold folds the case of names, which are then written folded ("ho chi minh city") unless an alias renames them.
+	Fold bool
+	// Aliases renames stations, "Saigon" to "Ho Chi Minh City". Aliases go through the other steps too, names don't.
+	Aliases map[string]string
+}
+
+// LoadAliases reads a CSV file of "alias,name" records, lines starting with # are comments.
+func LoadAliases(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open aliases: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.Comment = '#'
+	aliases := make(map[string]string)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read aliases: %w", err)
+		}
+		if prev, ok := aliases[record[0]]; ok && prev != record[1] {
+			return nil, fmt.Errorf("alias %q is both %q and %q", record[0], prev, record[1])
+		}
+		aliases[record[0]] = record[1]
+	}
+	return aliases, nil
+}
+
+// canonicalizer applies a Canonical, a worker has its own as case folding isn't safe for concurrent use.
+type canonicalizer struct {
+	c       *Canonical
+	aliases map[string]string // shared read-only, keyed by the canonical names of the aliases
+	fold    cases.Caser
+}
+
+// canonicalAliases keys the aliases of c by their canonical names. The names aliases point to are aliases of
+// themselves, so they're written the way the aliases spell them whatever the other steps do.
+func canonicalAliases(c *Canonical) map[string]string {
+	aliases := make(map[string]string, 2*len(c.Aliases))
+	cz := &canonicalizer{c: c, fold: cases.Fold()}
+	for _, name := range c.Aliases {
+		aliases[cz.apply([]byte(name))] = name
+	}
+	for alias, name := range c.Aliases {
+		aliases[cz.apply([]byte(alias))] = name
+	}
+	return aliases
+}
+
+func newCanonicalizer(c *Canonical, aliases map[string]string) *canonicalizer {
+	return &canonicalizer{c: c, aliases: aliases, fold: cases.Fold()}
+}
+
+// name returns the canonical name of a station.
+func (cz *canonicalizer) name(name []byte) []byte {
+	n := cz.apply(name)
+	if alias, ok := cz.aliases[n]; ok {
+		return []byte(alias)
+	}
+	return []byte(n)
+}
+
+func (cz *canonicalizer) apply(name []byte) string {
+	if cz.c.Trim {
+		name = bytes.TrimSpace(name)
+	}
+	if cz.c.NFC {
+		name = norm.NFC.Bytes(name)
+	}
+	if cz.c.Fold {
+		return cz.fold.String(string(name))
+	}
+	return string(name)
+}
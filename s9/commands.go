@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/minhtri06/1brc/query"
+	"github.com/minhtri06/1brc/schema"
+	"github.com/minhtri06/1brc/writeresult"
+)
+
+// Running the binary without arguments keeps the original behavior (profile one run over inputFile).
+// The sub-commands below turn the solution into a small tool.
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "run":
+		return runRunCommand(args)
+	case "coordinator":
+		return runCoordinatorCommand(args)
+	case "worker":
+		return runWorkerCommand(args)
+	case "serve":
+		return runServeCommand(args)
+	case "query":
+		return runQueryCommand(args)
+	case "anomalies":
+		return runAnomaliesCommand(args)
+	case "baseline":
+		return runBaselineCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func runRunCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	file := fs.String("file", inputFile, "input file")
+	out := fs.String("out", "/dev/stdout", "file to write the result to")
+	progress := fs.Bool("progress", false, "report progress on stderr")
+	interval := fs.Duration("progress-interval", time.Second, "time between progress reports")
+	numWorkers := fs.Int("workers", runtime.NumCPU(), "number of workers")
+	chunkSize := fs.Int64("chunk-size", defaultChunkSize, "size in bytes of the chunks workers take from the file")
+	parseSchema := schemaFlags(fs)
+	columns := fs.String("columns", "", `comma separated names of the value columns of rows such as "Station;temp;humidity"`)
+	timeFormat := fs.String("time", "", `format of the timestamp column after the station name: "rfc3339" or "unix"`)
+	encodingName := fs.String("encoding", "utf-8", `encoding of the file: "utf-8", "latin1", "windows-1252" or "utf-16le"`)
+	lineFormat := fs.String("lines", "", `how lines are written, comma separated "lf", "crlf" and "quotes", sniffed when empty`)
+	window := fs.String("window", "", `group rows in tumbling windows by their timestamp: "hour", "day" or "month"`)
+	catalogueFile := fs.String("catalogue", "", "CSV or JSON file mapping stations to city, country and region, to add rollups")
+	strict := fs.Bool("strict", false, "fail when stations are missing from the catalogue instead of grouping them as unknown")
+	include := fs.String("include", "", "file with the only stations to keep, one per line")
+	exclude := fs.String("exclude", "", "file with stations to drop, one per line")
+	match := fs.String("match", "", "regular expression the names of the stations to keep must match")
+	trim := fs.Bool("trim", false, "drop white space around station names")
+	nfc := fs.Bool("nfc", false, "normalize station names to Unicode NFC, so composed and decomposed spellings match")
+	fold := fs.Bool("fold", false, "fold the case of station names")
+	aliasesFile := fs.String("aliases", "", `CSV file of "alias,name" records renaming stations`)
+	validate := fs.Bool("validate", false, "fail on rows out of the challenge rules, or of the -limit flags")
+	limits := ChallengeLimits
+	fs.IntVar(&limits.MaxNameLength, "limit-name", limits.MaxNameLength, "longest station name in bytes with -validate")
+	fs.Float64Var(&limits.MinValue, "limit-min", limits.MinValue, "lowest value with -validate")
+	fs.Float64Var(&limits.MaxValue, "limit-max", limits.MaxValue, "highest value with -validate")
+	filter := &Filter{}
+	fs.Func("min", "drop values below this one", floatFlag(&filter.MinValue))
+	fs.Func("max", "drop values above this one", floatFlag(&filter.MaxValue))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	sch, err := parseSchema()
+	if err != nil {
+		return err
+	}
+	sch.Columns = schema.ParseColumns(*columns)
+	if sch.Time, err = schema.ParseTimeFormat(*timeFormat); err != nil {
+		return err
+	}
+
+	opts := Options{ProgressInterval: *interval, NumWorkers: *numWorkers, ChunkSize: *chunkSize, Schema: sch}
+	if opts.Window, err = parseWindow(*window); err != nil {
+		return err
+	}
+	if opts.Encoding, err = parseEncoding(*encodingName); err != nil {
+		return err
+	}
+	if opts.Lines, err = parseLines(*lineFormat); err != nil {
+		return err
+	}
+
+	if *include != "" {
+		if filter.Include, err = readNames(*include); err != nil {
+			return err
+		}
+	}
+	if *exclude != "" {
+		if filter.Exclude, err = readNames(*exclude); err != nil {
+			return err
+		}
+	}
+	if *match != "" {
+		if filter.Pattern, err = regexp.Compile(*match); err != nil {
+			return fmt.Errorf("invalid -match: %w", err)
+		}
+	}
+	if filter.Include != nil || filter.Exclude != nil || filter.Pattern != nil || filter.MinValue != nil || filter.MaxValue != nil {
+		opts.Filter = filter
+		defer func() { fmt.Fprintln(os.Stderr, filter.Filtered) }()
+	}
+	if *trim || *nfc || *fold || *aliasesFile != "" {
+		opts.Canonical = &Canonical{Trim: *trim, NFC: *nfc, Fold: *fold}
+		if *aliasesFile != "" {
+			if opts.Canonical.Aliases, err = LoadAliases(*aliasesFile); err != nil {
+				return err
+			}
+		}
+	}
+	if *validate {
+		opts.Limits = &limits
+	}
+	if *progress {
+		opts.Progress = progressPrinter(os.Stderr, isTerminal(os.Stderr))
+	}
+
+	var catalogue *Catalogue
+	if *catalogueFile != "" {
+		if opts.Window != WindowNone || sch.NumColumns() > 1 {
+			return errors.New("rollups support neither windows nor several value columns")
+		}
+		if catalogue, err = LoadCatalogue(*catalogueFile); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if opts.Window != WindowNone {
+		table, err := AggregateMetrics(ctx, *file, opts)
+		if err != nil {
+			return err
+		}
+		names, res := formatWindows(table, sch, opts.Window)
+		return writeWindows(*out, names, res)
+	}
+	if sch.NumColumns() > 1 {
+		table, err := AggregateMetrics(ctx, *file, opts)
+		if err != nil {
+			return err
+		}
+		names, res := formatMetrics(table, sch)
+		return writeresult.MetricsToFile(*out, names, res)
+	}
+
+	agg, err := AggregateContext(ctx, *file, opts)
+	if err != nil {
+		return err
+	}
+
+	if catalogue != nil {
+		rollups, unknown := catalogue.Rollup(agg, sch.Divisor())
+		if len(unknown) > 0 {
+			if *strict {
+				return fmt.Errorf("%w: %s", errUnknownStations, strings.Join(unknown, ", "))
+			}
+			fmt.Fprintf(os.Stderr, "%d stations missing from the catalogue, grouped as %s: %s\n", len(unknown), unknownGroup, strings.Join(unknown, ", "))
+		}
+
+		names, res := []string{"station"}, []map[string]string{formatResult(agg, sch)}
+		for _, r := range rollups {
+			names = append(names, r.Level)
+			res = append(res, formatResult(r.Groups, sch))
+		}
+		return writeresult.MetricsToFile(*out, names, res)
+	}
+
+	return writeresult.ToFile(*out, formatResult(agg, sch))
+}
+
+// schemaFlags adds -sep, -scale and -signs to fs, the returned function builds the schema once fs is parsed.
+func schemaFlags(fs *flag.FlagSet) func() (schema.Schema, error) {
+	sep := fs.String("sep", ";", `separator between the station name and the value, "tab" for tabs`)
+	scale := fs.Int("scale", schema.Default.Scale, "number of fractional digits of the values, 0 for integers")
+	signs := fs.String("signs", "-", `signs the values may start with, "-+" to also accept a leading plus`)
+	return func() (schema.Schema, error) {
+		sch := schema.Schema{Scale: *scale}
+		var err error
+		if sch.Separator, err = schema.ParseSeparator(*sep); err != nil {
+			return schema.Schema{}, err
+		}
+		if sch.Signs, err = schema.ParseSigns(*signs); err != nil {
+			return schema.Schema{}, err
+		}
+		return sch, nil
+	}
+}
+
+func runCoordinatorCommand(args []string) error {
+	fs := flag.NewFlagSet("coordinator", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	file := fs.String("file", inputFile, "input file, must be reachable by every worker at the same path")
+	numParts := fs.Int("parts", 4*runtime.NumCPU(), "number of parts to split the file into")
+	lease := fs.Duration("lease", 30*time.Second, "time a worker has to return a part before it is handed out again")
+	out := fs.String("out", "result.txt", "file to write the result to")
+	parseSchema := schemaFlags(fs)
+	encodingName := fs.String("encoding", "utf-8", `encoding of the file: "utf-8", "latin1", "windows-1252" or "utf-16le"`)
+	lineFormat := fs.String("lines", "", `how lines are written, comma separated "lf", "crlf" and "quotes", sniffed when empty`)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	sch, err := parseSchema()
+	if err != nil {
+		return err
+	}
+	opts := Options{Schema: sch}
+	if opts.Encoding, err = parseEncoding(*encodingName); err != nil {
+		return err
+	}
+	if opts.Lines, err = parseLines(*lineFormat); err != nil {
+		return err
+	}
+	c, err := newCoordinator(*file, *numParts, *lease, opts)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	agg, err := c.listenAndWait(ctx, *addr)
+	if err != nil {
+		return err
+	}
+
+	return writeresult.ToFile(*out, formatResult(agg, sch))
+}
+
+func runWorkerCommand(args []string) error {
+	fs := flag.NewFlagSet("worker", flag.ContinueOnError)
+	coordinatorURL := fs.String("coordinator", "http://localhost:8080", "base URL of the coordinator")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return runWorker(ctx, *coordinatorURL, nil)
+}
+
+// toResult formats the aggregation the way writeresult expects.
+func toResult(agg map[string]*Aggregation) map[string]string {
+	return formatResult(agg, schema.Default)
+}
+
+// formatResult is toResult with as many decimals as the values of the schema have.
+func formatResult(agg map[string]*Aggregation, s schema.Schema) map[string]string {
+	d := s.Decimals()
+	res := make(map[string]string, len(agg))
+	for name, a := range agg {
+		res[name] = fmt.Sprintf("%.*f/%.*f/%.*f", d, a.Min, d, a.Mean, d, a.Max)
+	}
+	return res
+}
+
+// formatMetrics is formatResult for every metric of the table, stations without a value for a metric are left out.
+func formatMetrics(table *MetricTable, s schema.Schema) (names []string, res []map[string]string) {
+	d := s.Decimals()
+	for _, m := range table.Metrics {
+		r := make(map[string]string, len(table.Stations))
+		for i, name := range table.Stations {
+			if m.Count[i] == 0 {
+				continue
+			}
+			r[name] = fmt.Sprintf("%.*f/%.*f/%.*f", d, m.Min[i], d, m.Mean[i], d, m.Max[i])
+		}
+		names = append(names, m.Name)
+		res = append(res, r)
+	}
+	return names, res
+}
+
+// formatWindows is formatMetrics for a table with windows, the windows of each station stay in chronological order.
+func formatWindows(table *MetricTable, s schema.Schema, w Window) (names []string, res []map[string][]writeresult.Window) {
+	d := s.Decimals()
+	for _, m := range table.Metrics {
+		r := make(map[string][]writeresult.Window)
+		for i, name := range table.Stations {
+			if m.Count[i] == 0 {
+				continue
+			}
+			r[name] = append(r[name], writeresult.Window{
+				Label:  w.label(table.Windows[i]),
+				Result: fmt.Sprintf("%.*f/%.*f/%.*f", d, m.Min[i], d, m.Mean[i], d, m.Max[i]),
+			})
+		}
+		names = append(names, m.Name)
+		res = append(res, r)
+	}
+	return names, res
+}
+
+// writeWindows writes the windows of every metric, under a "name:" line when there are several.
+func writeWindows(filename string, names []string, res []map[string][]writeresult.Window) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for i, name := range names {
+		if len(names) > 1 {
+			if _, err := fmt.Fprintf(f, "%s:\n", name); err != nil {
+				return err
+			}
+		}
+		if err := writeresult.WindowsToWriter(f, res[i]); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func runServeCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	maxBody := fs.Int64("max-body", defaultMaxBody, "largest request body in bytes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *maxBody < 1 {
+		return fmt.Errorf("invalid max body size %d, expected at least 1 byte", *maxBody)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return newServer(*maxBody).serve(ctx, *addr)
+}
+
+func runQueryCommand(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	file := fs.String("file", inputFile, "input file")
+	catalogueFile := fs.String("catalogue", "", "CSV or JSON file mapping stations to city, country and region, to query by them")
+	explain := fs.Bool("explain", false, "print what is pushed down into the scan on stderr")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errNoQuery
+	}
+
+	q, err := query.Parse(strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+	var catalogue *Catalogue
+	if *catalogueFile != "" {
+		if catalogue, err = LoadCatalogue(*catalogueFile); err != nil {
+			return err
+		}
+	}
+	if *explain {
+		filter, residual, err := planQuery(q, catalogue, schema.Default, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "scan filter: %s\nresidual: %v\n", describeFilter(filter, schema.Default), residual)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	res, err := RunQuery(ctx, *file, q, catalogue, Options{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(res.Columns, "\t"))
+	for _, row := range res.Rows {
+		for i, v := range row {
+			if i > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			switch {
+			case res.Columns[i] == "count" || !v.IsNum:
+				fmt.Fprint(w, v)
+			default:
+				fmt.Fprintf(w, "%.1f", v.Num)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+func runAnomaliesCommand(args []string) error {
+	fs := flag.NewFlagSet("anomalies", flag.ContinueOnError)
+	file := fs.String("file", inputFile, "input file")
+	out := fs.String("out", "/dev/stdout", "file to write the anomalies to")
+	numWorkers := fs.Int("workers", runtime.NumCPU(), "number of workers")
+	chunkSize := fs.Int64("chunk-size", defaultChunkSize, "size in bytes of the chunks workers take from the file")
+	parseSchema := schemaFlags(fs)
+	encodingName := fs.String("encoding", "utf-8", `encoding of the file: "utf-8", "latin1", "windows-1252" or "utf-16le"`)
+	aopts := AnomalyOptions{}
+	fs.Float64Var(&aopts.K, "k", 0, "flag values more than this many standard deviations away from the mean of their station")
+	fs.Func("lower", "flag values below this percentile of their station", floatFlag(&aopts.Lower))
+	fs.Func("upper", "flag values above this percentile of their station", floatFlag(&aopts.Upper))
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	sch, err := parseSchema()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	opts := Options{NumWorkers: *numWorkers, ChunkSize: *chunkSize, Schema: sch}
+	if opts.Encoding, err = parseEncoding(*encodingName); err != nil {
+		return err
+	}
+	anomalies, stats, err := DetectAnomalies(ctx, *file, opts, aopts)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "line\toffset\tstation\tvalue\tdeviation")
+	d := sch.Decimals()
+	for _, a := range anomalies {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%.*f\t%.2f\n", a.Line, a.Offset, a.Station, d, a.Value, a.Deviation)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d anomalies among the rows of %d stations\n", len(anomalies), len(stats))
+	return f.Close()
+}
+
+func runBaselineCommand(args []string) error {
+	fs := flag.NewFlagSet("baseline", flag.ContinueOnError)
+	file := fs.String("file", inputFile, "input file")
+	baselineFile := fs.String("baseline", "", "previous result to compare with, as written by run or a JSON snapshot of serve")
+	top := fs.Int("top", 10, "number of biggest changes to list, 0 for every station")
+	numWorkers := fs.Int("workers", runtime.NumCPU(), "number of workers")
+	parseSchema := schemaFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *baselineFile == "" {
+		return errors.New("-baseline is required")
+	}
+
+	sch, err := parseSchema()
+	if err != nil {
+		return err
+	}
+	baseline, err := LoadBaseline(*baselineFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	agg, err := AggregateContext(ctx, *file, Options{NumWorkers: *numWorkers, Schema: sch})
+	if err != nil {
+		return err
+	}
+	report := CompareBaseline(agg, baseline, sch.Decimals())
+
+	fmt.Printf("%d stations compared, %d new, %d gone\n", len(report.Deltas), len(report.New), len(report.Gone))
+	deltas := report.Deltas
+	if *top > 0 && len(deltas) > *top {
+		deltas = deltas[:*top]
+	}
+	if len(deltas) > 0 {
+		d := sch.Decimals()
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "station\tmean\tmin\tmax")
+		for _, delta := range deltas {
+			fmt.Fprintf(w, "%s\t%+.*f\t%+.*f\t%+.*f\n", delta.Name, d, delta.Mean, d, delta.Min, d, delta.Max)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(report.New) > 0 {
+		fmt.Printf("\nnew: %s\n", strings.Join(report.New, ", "))
+	}
+	if len(report.Gone) > 0 {
+		fmt.Printf("\ngone: %s\n", strings.Join(report.Gone, ", "))
+	}
+	return nil
+}
+
+func describeFilter(f *Filter, sch schema.Schema) string {
+	if f == nil {
+		return "none"
+	}
+	var parts []string
+	if f.Include != nil {
+		parts = append(parts, fmt.Sprintf("%d included stations", len(f.Include)))
+	}
+	if f.Exclude != nil {
+		parts = append(parts, fmt.Sprintf("%d excluded stations", len(f.Exclude)))
+	}
+	if f.Pattern != nil {
+		parts = append(parts, "name matches "+f.Pattern.String())
+	}
+	if f.MinValue != nil {
+		parts = append(parts, fmt.Sprintf("value >= %.*f", sch.Decimals(), *f.MinValue))
+	}
+	if f.MaxValue != nil {
+		parts = append(parts, fmt.Sprintf("value <= %.*f", sch.Decimals(), *f.MaxValue))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// readNames reads one station name per line, skipping empty lines.
+func readNames(filename string) ([]string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+// floatFlag sets *p to the value of the flag, so unset flags stay nil.
+func floatFlag(p **float64) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*p = &v
+		return nil
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
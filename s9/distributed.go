@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minhtri06/1brc/schema"
+)
+
+// Distributed mode: a coordinator splits a file on a shared filesystem into parts and hands them
+// out to worker processes over HTTP/JSON. Each worker reads its part like a worker of AggregateContext,
+// with the schema, encoding and line format of the task, and sends back the partial entries, which the
+// coordinator merges.
+//
+// A part is leased to one worker at a time. If the worker does not report back before the lease
+// expires (it died, hung or lost the network), the part is handed out again under a new lease. Only
+// results of the current lease count, so a slow worker coming back late can neither double count nor
+// give back a part another worker holds. A part that fails maxTaskFailures times fails the job with
+// the error of the last worker.
+
+const (
+	workerPollInterval = 500 * time.Millisecond
+	maxTaskFailures    = 3
+)
+
+type taskState int
+
+const (
+	taskPending taskState = iota
+	taskLeased
+	taskDone
+)
+
+type task struct {
+	ID     int    `json:"id"`
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	// Lease changes every time the part is handed out, workers send it back with their result
+	Lease int `json:"lease"`
+
+	Schema   schema.Schema `json:"schema"`
+	Encoding Encoding      `json:"encoding"`
+	Lines    LineFormat    `json:"lines"`
+
+	state    taskState
+	deadline time.Time
+	failures int
+}
+
+type partialEntry struct {
+	Name  string  `json:"name"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Sum   int64   `json:"sum"`
+	Count int64   `json:"count"`
+}
+
+type partialResult struct {
+	TaskID  int            `json:"taskId"`
+	Lease   int            `json:"lease"`
+	Entries []partialEntry `json:"entries,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+type coordinator struct {
+	lease  time.Duration
+	schema schema.Schema
+
+	mu        sync.Mutex
+	tasks     []*task
+	remaining int
+	agg       map[string]*Aggregation
+	err       error // set when a part failed maxTaskFailures times, the job is then over
+	done      chan struct{}
+}
+
+// newCoordinator splits filename into numParts parts for workers to read with the Schema, Encoding and Lines of
+// opts, the other options aren't supported. The line format is sniffed once here if opts doesn't set it.
+func newCoordinator(filename string, numParts int, lease time.Duration, opts Options) (*coordinator, error) {
+	sch, err := opts.schema()
+	if err != nil {
+		return nil, err
+	}
+	if sch.NumColumns() > 1 || sch.Time != schema.TimeNone {
+		return nil, errors.New("distributed mode supports neither timestamps nor several value columns")
+	}
+	lines, err := opts.lines(filename)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := splitsFile(filename, numParts, opts.Encoding.unit())
+	if err != nil {
+		return nil, fmt.Errorf("cannot split file: %w", err)
+	}
+
+	c := &coordinator{
+		lease:     lease,
+		schema:    sch,
+		tasks:     make([]*task, len(parts)),
+		remaining: len(parts),
+		agg:       make(map[string]*Aggregation, 10000),
+		done:      make(chan struct{}),
+	}
+	for i, part := range parts {
+		c.tasks[i] = &task{
+			ID:       i,
+			File:     filename,
+			Offset:   part.offset,
+			Length:   part.length,
+			Schema:   sch,
+			Encoding: opts.Encoding,
+			Lines:    lines,
+		}
+	}
+	if c.remaining == 0 {
+		close(c.done)
+	}
+
+	return c, nil
+}
+
+func (c *coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /claim", c.handleClaim)
+	mux.HandleFunc("POST /result", c.handleResult)
+	return mux
+}
+
+// handleClaim leases the next available part to the caller.
+// It responds 204 when every part is leased but not all are done yet, and 410 when the job is finished.
+func (c *coordinator) handleClaim(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	if c.remaining == 0 || c.err != nil {
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	now := time.Now()
+	var claimed *task
+	for _, t := range c.tasks {
+		if t.state == taskPending || (t.state == taskLeased && now.After(t.deadline)) {
+			t.state = taskLeased
+			t.deadline = now.Add(c.lease)
+			t.Lease++
+			claimed = t
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if claimed == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, claimed)
+}
+
+func (c *coordinator) handleResult(w http.ResponseWriter, r *http.Request) {
+	var res partialResult
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, fmt.Sprintf("invalid result: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if res.TaskID < 0 || res.TaskID >= len(c.tasks) {
+		http.Error(w, fmt.Sprintf("unknown task %d", res.TaskID), http.StatusBadRequest)
+		return
+	}
+	t := c.tasks[res.TaskID]
+	if t.state != taskLeased || res.Lease != t.Lease || c.err != nil {
+		// Our lease expired and the part went to someone else, who may have finished it already, or the job failed
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if res.Error != "" {
+		t.failures++
+		if t.failures >= maxTaskFailures {
+			c.err = fmt.Errorf("part %d failed %d times: %s", t.ID, t.failures, res.Error)
+			close(c.done)
+		} else {
+			// Give the part back so another worker can retry it
+			t.state = taskPending
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	for _, e := range res.Entries {
+		mergeInto(c.agg, []byte(e.Name), &Aggregation{Min: e.Min, Max: e.Max, sum: e.Sum, count: e.Count})
+	}
+	t.state = taskDone
+	c.remaining--
+	if c.remaining == 0 {
+		close(c.done)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// wait blocks until every part has been merged and returns the final aggregation, or until a part failed too
+// many times and returns its error.
+func (c *coordinator) wait(ctx context.Context) (map[string]*Aggregation, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	for _, a := range c.agg {
+		a.Mean = float64(a.sum) / float64(a.count) / c.schema.Divisor()
+	}
+	return c.agg, nil
+}
+
+// listenAndWait serves the coordinator API on addr until the job is finished.
+func (c *coordinator) listenAndWait(ctx context.Context, addr string) (map[string]*Aggregation, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen: %w", err)
+	}
+	srv := &http.Server{Handler: c.handler()}
+	go srv.Serve(ln)
+
+	agg, err := c.wait(ctx)
+
+	// Keep answering for a moment so idle workers get told the job is over instead of a refused connection
+	if ctx.Err() == nil {
+		time.Sleep(2 * workerPollInterval)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+
+	return agg, err
+}
+
+// runWorker claims parts from the coordinator at baseURL and aggregates them until the job is finished.
+func runWorker(ctx context.Context, baseURL string, client *http.Client) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for {
+		t, err := claimTask(ctx, client, baseURL)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return nil
+		}
+		if t.ID < 0 {
+			// Nothing to do right now, parts may come back if another worker dies
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(workerPollInterval):
+			}
+			continue
+		}
+
+		res := partialResult{TaskID: t.ID, Lease: t.Lease}
+		entries, err := aggregateTask(ctx, t)
+		if err != nil {
+			res.Error = err.Error()
+		}
+		res.Entries = entries
+
+		if err := postResult(ctx, client, baseURL, &res); err != nil {
+			return err
+		}
+	}
+}
+
+// claimTask returns nil when the job is finished, and a task with a negative ID when there's nothing to do yet.
+func claimTask(ctx context.Context, client *http.Client, baseURL string) (*task, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/claim", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot claim task: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusGone:
+		return nil, nil
+	case http.StatusNoContent:
+		return &task{ID: -1}, nil
+	case http.StatusOK:
+		var t task
+		if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+			return nil, fmt.Errorf("invalid task: %w", err)
+		}
+		return &t, nil
+	default:
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("cannot claim task: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+}
+
+func postResult(ctx context.Context, client *http.Client, baseURL string, res *partialResult) error {
+	body, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/result", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot post result of task %d: %w", res.TaskID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("cannot post result of task %d: %s: %s", res.TaskID, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// aggregateTask reads the part of a task like a worker of runWorkers reads a chunk.
+func aggregateTask(ctx context.Context, t *task) ([]partialEntry, error) {
+	f, err := os.Open(t.File)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+
+	part := FilePart{offset: t.Offset, length: t.Length}
+	var counter partCounter
+	r, skipped, err := openPart(io.NewSectionReader(f, part.offset, part.length), part, t.Encoding, &counter)
+	if err != nil {
+		return nil, fmt.Errorf("task %d: %w", t.ID, err)
+	}
+	a := newChunkAggregator(t.Schema, WindowNone, t.Lines)
+	a.offset = part.offset + skipped
+	if err := a.add(ctx, r, nil); err != nil {
+		return nil, fmt.Errorf("task %d: %w", t.ID, err)
+	}
+
+	// The generic path keeps the statistics in its single column
+	divisor := t.Schema.Divisor()
+	entries := make([]partialEntry, 0, a.size)
+	for _, e := range a.entries() {
+		p := partialEntry{Name: string(e.name)}
+		if a.columns == nil {
+			p.Min, p.Max, p.Sum, p.Count = e.value.Min, e.value.Max, e.value.sum, e.value.count
+		} else {
+			col := &a.columns[0]
+			p.Min, p.Max = float64(col.min[e.index])/divisor, float64(col.max[e.index])/divisor
+			p.Sum, p.Count = col.sum[e.index], col.count[e.index]
+		}
+		entries = append(entries, p)
+	}
+	return entries, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Encoding is the character encoding of a file. Workers transcode their chunks to UTF-8 while reading them, so the
+// map, the filters and the result only ever see UTF-8 names.
+type Encoding uint8
+
+const (
+	EncodingUTF8        Encoding = iota // read as is
+	EncodingLatin1                      // ISO 8859-1
+	EncodingWindows1252                 // Latin-1 with printable characters such as € in 0x80..0x9F
+	EncodingUTF16LE                     // a byte order mark at the start of the file is skipped
+)
+
+func parseEncoding(s string) (Encoding, error) {
+	switch s {
+	case "", "utf-8":
+		return EncodingUTF8, nil
+	case "latin1", "iso-8859-1":
+		return EncodingLatin1, nil
+	case "windows-1252", "cp1252":
+		return EncodingWindows1252, nil
+	case "utf-16le":
+		return EncodingUTF16LE, nil
+	}
+	return 0, fmt.Errorf("unknown encoding %q, expected utf-8, latin1, windows-1252 or utf-16le", s)
+}
+
+// decoder returns the decoder to UTF-8, nil for UTF-8.
+func (e Encoding) decoder() *encoding.Decoder {
+	switch e {
+	case EncodingLatin1:
+		return charmap.ISO8859_1.NewDecoder()
+	case EncodingWindows1252:
+		return charmap.Windows1252.NewDecoder()
+	case EncodingUTF16LE:
+		// The byte order mark is decoded like any other character, and skipped in UTF-8
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewDecoder()
+	}
+	return nil
+}
+
+// unit is the size in bytes of the code units, files are only split between them.
+func (e Encoding) unit() int {
+	if e == EncodingUTF16LE {
+		return 2
+	}
+	return 1
+}
+
+// openPart returns a reader of the UTF-8 text of a part of a file read by r, without the byte order mark of the
+// file, and the number of bytes of UTF-8 text skipped. Parts of a file in another encoding are counted in bytes of
+// the file as they're read.
+func openPart(r io.Reader, part FilePart, enc Encoding, counter *partCounter) (io.Reader, int64, error) {
+	if dec := enc.decoder(); dec != nil {
+		counter.transcoded = true
+		r = transform.NewReader(&countingReader{r: r, counter: counter}, dec)
+	}
+	r, skipped, err := skipBOM(r, part)
+	if err != nil {
+		return nil, 0, err
+	}
+	counter.add(skipped, 0)
+	return r, skipped, nil
+}
+
+// countingReader adds the bytes read from r to counter.
+type countingReader struct {
+	r       io.Reader
+	counter *partCounter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.counter.bytes.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/minhtri06/1brc/schema"
+)
+
+// Filter drops rows inside the parsing loop, before they reach the custom map.
+type Filter struct {
+	// Include keeps only the rows of these stations when not nil, Exclude drops the rows of these stations.
+	Include []string
+	Exclude []string
+	// Pattern, if set, keeps only the stations whose name it matches.
+	Pattern *regexp.Regexp
+	// MinValue and MaxValue, if set, drop values outside of them. With several value columns only the value is
+	// dropped, not the whole row.
+	MinValue *float64
+	MaxValue *float64
+
+	// Filtered is set by the aggregation to the number of rows dropped by each predicate.
+	Filtered FilterCounts
+}
+
+type FilterCounts struct {
+	Name    int64 // by Include or Exclude
+	Pattern int64
+	Value   int64 // values out of bounds, with several value columns only the value is dropped
+}
+
+func (c *FilterCounts) add(other FilterCounts) {
+	c.Name += other.Name
+	c.Pattern += other.Pattern
+	c.Value += other.Value
+}
+
+func (c FilterCounts) String() string {
+	return fmt.Sprintf("%d rows filtered: %d by name, %d by pattern, %d by value", c.Name+c.Pattern+c.Value, c.Name, c.Pattern, c.Value)
+}
+
+// rowFilter is a Filter ready for the parsing loop: names are looked up by the hash the loop already computed,
+// and bounds are scaled like the values.
+type rowFilter struct {
+	include nameSet
+	exclude nameSet
+	pattern *regexp.Regexp
+	min     int64
+	max     int64
+}
+
+func newRowFilter(f *Filter, sch schema.Schema) *rowFilter {
+	rf := &rowFilter{pattern: f.Pattern, min: math.MinInt64, max: math.MaxInt64}
+	if f.Include != nil {
+		rf.include = newNameSet(f.Include)
+	}
+	if len(f.Exclude) > 0 {
+		rf.exclude = newNameSet(f.Exclude)
+	}
+	if f.MinValue != nil {
+		rf.min = int64(math.Ceil(*f.MinValue*sch.Divisor() - 1e-9))
+	}
+	if f.MaxValue != nil {
+		rf.max = int64(math.Floor(*f.MaxValue*sch.Divisor() + 1e-9))
+	}
+	return rf
+}
+
+// nameSet is a set of station names keyed by their FNV-1a hash.
+type nameSet map[uint64][]string
+
+func newNameSet(names []string) nameSet {
+	s := make(nameSet, len(names))
+	for _, name := range names {
+		s.add(fnvHash([]byte(name)), name)
+	}
+	return s
+}
+
+func (s nameSet) add(hash uint64, name string) {
+	s[hash] = append(s[hash], name)
+}
+
+func (s nameSet) contains(hash uint64, name []byte) bool {
+	for _, n := range s[hash] {
+		if n == string(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// fnvHash is the hash the parsing loops compute on the way through a name.
+func fnvHash(name []byte) uint64 {
+	hash := uint64(fnvOffset)
+	for _, c := range name {
+		hash ^= uint64(c)
+		hash *= uint64(fnvPrime)
+	}
+	return hash
+}
+
+// keepName reports whether the rows of the station pass the filter of a, and counts the ones that don't.
+// Pattern results are remembered per station, so the regular expression only runs once per station and worker.
+func (a *chunkAggregator) keepName(hash uint64, name []byte) bool {
+	f := a.filter
+	if f.include != nil && !f.include.contains(hash, name) || f.exclude != nil && f.exclude.contains(hash, name) {
+		a.filtered.Name++
+		return false
+	}
+	if f.pattern == nil || a.matched.contains(hash, name) {
+		return true
+	}
+	if a.unmatched.contains(hash, name) {
+		a.filtered.Pattern++
+		return false
+	}
+	if !f.pattern.Match(name) {
+		a.unmatched.add(hash, string(name))
+		a.filtered.Pattern++
+		return false
+	}
+	a.matched.add(hash, string(name))
+	return true
+}
+
+// keepValue reports whether a scaled value is within the bounds of the filter of a, and counts the ones that aren't.
+func (a *chunkAggregator) keepValue(v int64) bool {
+	if v < a.filter.min || v > a.filter.max {
+		a.filtered.Value++
+		return false
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"unicode/utf8"
+
+	"github.com/minhtri06/1brc/schema"
+)
+
+// Limits are the bounds Options.Limits holds rows to, names must also be valid UTF-8 and not empty.
+type Limits struct {
+	MaxNameLength int // in bytes
+	MinValue      float64
+	MaxValue      float64
+}
+
+// ChallengeLimits are the rules of the challenge.
+var ChallengeLimits = Limits{MaxNameLength: 100, MinValue: -99.9, MaxValue: 99.9}
+
+// LimitError is a row out of the Limits.
+type LimitError struct {
+	Offset int64  // of the first byte of the line in the file, or in the reader
+	Line   []byte // without its newline character, cut after maxLimitErrorLine bytes
+	Reason string
+}
+
+const maxLimitErrorLine = 120
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("line at offset %d %s: %q", e.Offset, e.Reason, e.Line)
+}
+
+// rowLimits are Limits ready for the parsing loops, with bounds scaled like the values.
+type rowLimits struct {
+	maxName  int
+	min, max int64
+}
+
+func newRowLimits(l *Limits, sch schema.Schema) (*rowLimits, error) {
+	if l.MaxNameLength < 1 || l.MinValue > l.MaxValue {
+		return nil, fmt.Errorf("invalid limits %+v", *l)
+	}
+	return &rowLimits{
+		maxName: l.MaxNameLength,
+		min:     int64(math.Ceil(l.MinValue*sch.Divisor() - 1e-9)),
+		max:     int64(math.Floor(l.MaxValue*sch.Divisor() + 1e-9)),
+	}, nil
+}
+
+// checkName checks the name of a station, the parsing loops only do it when a name is first inserted in the map,
+// as names are compared byte by byte with the ones already there.
+func (l *rowLimits) checkName(name []byte) string {
+	switch {
+	case len(name) == 0:
+		return "has an empty station name"
+	case len(name) > l.maxName:
+		return fmt.Sprintf("has a station name of %d bytes, longer than %d", len(name), l.maxName)
+	case !utf8.Valid(name):
+		return "has a station name that isn't valid UTF-8"
+	}
+	return ""
+}
+
+func (l *rowLimits) checkValue(v int64, sch schema.Schema) string {
+	if v < l.min || v > l.max {
+		d := sch.Decimals()
+		return fmt.Sprintf("has a value out of %.*f..%.*f", d, float64(l.min)/sch.Divisor(), d, float64(l.max)/sch.Divisor())
+	}
+	return ""
+}
+
+// limitError returns the error of the line of chunk starting at start.
+func (a *chunkAggregator) limitError(chunk []byte, start int, reason string) error {
+	line := chunk[start:]
+	line = line[:bytes.IndexByte(line, '\n')]
+	if len(line) > maxLimitErrorLine {
+		line = line[:maxLimitErrorLine]
+	}
+	return &LimitError{Offset: a.offset + int64(start), Line: bytes.Clone(line), Reason: reason}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// LineFormat is how the lines of a file are written, beyond what the schema tells. A UTF-8 byte order mark at the
+// start of a file is skipped whatever the format.
+type LineFormat struct {
+	CRLF bool // lines may end with "\r\n"
+	// Quotes allows station names between double quotes, so they can contain the separator. A quote inside a quoted
+	// name is doubled: "Fort ""Apache"";1".
+	Quotes bool
+}
+
+// plain reports whether the hot path can read the lines.
+func (l LineFormat) plain() bool {
+	return !l.CRLF && !l.Quotes
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// sniffSize is how much of a file SniffLines reads.
+const sniffSize = 64 * 1024
+
+// SniffLines guesses the LineFormat of a file in enc from its first 64 KB, files whose first CRLF or quoted name come
+// later must set Options.Lines. A CRLF line read as LF is an error rather than a wrong value.
+func SniffLines(filename string, enc Encoding) (LineFormat, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return LineFormat{}, fmt.Errorf("cannot open file: %w", err)
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return LineFormat{}, fmt.Errorf("failed to read file: %w", err)
+	}
+	head = head[:n-n%enc.unit()]
+	if dec := enc.decoder(); dec != nil {
+		if head, err = dec.Bytes(head); err != nil {
+			return LineFormat{}, fmt.Errorf("cannot decode file: %w", err)
+		}
+	}
+	return sniffLines(head), nil
+}
+
+// crlfError is returned for a CRLF line read as LF, which happens when the sniff missed it.
+func crlfError(line []byte) error {
+	return fmt.Errorf("line %q ends with CRLF but lines were read as LF, set the line format to crlf", line)
+}
+
+func sniffLines(head []byte) LineFormat {
+	head = bytes.TrimPrefix(head, utf8BOM)
+	return LineFormat{
+		CRLF:   bytes.Contains(head, []byte("\r\n")),
+		Quotes: bytes.HasPrefix(head, []byte(`"`)) || bytes.Contains(head, []byte("\n\"")),
+	}
+}
+
+// parseLines parses the -lines flag, "" sniffs the file.
+func parseLines(s string) (*LineFormat, error) {
+	if s == "" {
+		return nil, nil
+	}
+	l := &LineFormat{}
+	for _, f := range strings.Split(s, ",") {
+		switch f {
+		case "lf":
+		case "crlf":
+			l.CRLF = true
+		case "quotes":
+			l.Quotes = true
+		default:
+			return nil, fmt.Errorf("unknown line format %q, expected lf, crlf or quotes", f)
+		}
+	}
+	return l, nil
+}
+
+// lines returns o.Lines, or sniffs the format of filename without it.
+func (o Options) lines(filename string) (LineFormat, error) {
+	if o.Lines != nil {
+		return *o.Lines, nil
+	}
+	return SniffLines(filename, o.Encoding)
+}
+
+// skipBOM skips the byte order mark at the start of the part of a file r reads, if there's one. It returns the
+// reader to go on with and the number of bytes skipped.
+func skipBOM(r io.Reader, part FilePart) (io.Reader, int64, error) {
+	if part.offset != 0 {
+		return r, 0, nil
+	}
+	head := make([]byte, len(utf8BOM))
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, 0, fmt.Errorf("failed to read file: %w", err)
+	}
+	if bytes.Equal(head[:n], utf8BOM) {
+		return r, int64(n), nil
+	}
+	return io.MultiReader(bytes.NewReader(head[:n]), r), 0, nil
+}
+
+// quotedName reads the quoted name starting at chunk[i], and returns it without its quotes with the index of the
+// separator after it. Names with doubled quotes are unescaped into a.nameBuf.
+func (a *chunkAggregator) quotedName(chunk []byte, i int) ([]byte, int, error) {
+	start := i
+	i++ // Skip the opening quote
+	nameStart := i
+	escaped := false
+	for {
+		switch chunk[i] {
+		case '\n':
+			return nil, 0, fmt.Errorf("unterminated quoted name in line %q", chunk[start:i])
+		case '"':
+			if chunk[i+1] != '"' {
+				name := chunk[nameStart:i]
+				if escaped {
+					a.nameBuf = a.nameBuf[:0]
+					for j := 0; j < len(name); j++ {
+						a.nameBuf = append(a.nameBuf, name[j])
+						if name[j] == '"' {
+							j++ // Skip the second quote of the pair
+						}
+					}
+					name = a.nameBuf
+				}
+				i++ // Skip the closing quote
+				if chunk[i] != a.schema.Separator {
+					end := start + bytes.IndexByte(chunk[start:], '\n')
+					return nil, 0, fmt.Errorf("missing separator after the quoted name in line %q", chunk[start:end])
+				}
+				return name, i, nil
+			}
+			escaped = true
+			i++ // Skip the first quote of the pair
+		}
+		i++
+	}
+}
@@ -2,19 +2,31 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
 	"runtime/pprof"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/schema"
 )
 
 const (
 	inputFile = "../measurements.txt"
 
 	// Custom Scanner
-	scanBufSize = 1024 * 1024 // 1 MB buffer size
+	scanBufSize    = 1024 * 1024      // 1 MB buffer size, grown for longer lines
+	maxScanBufSize = 64 * 1024 * 1024 // lines longer than this are an error
+	maxZeroReads   = 100              // consecutive empty reads before giving up, like bufio
+
+	// Scheduler
+	defaultChunkSize = 16 * 1024 * 1024 // 16 MB
 
 	// Custom map
 	mapSize   = 131072 // 2^17, power of two
@@ -29,16 +41,49 @@ type Aggregation struct {
 	Mean float64
 	Max  float64
 
-	count  int32
-	sumX10 int
+	// 64 bits even on 32-bit platforms. Values of schema.Default have at most 4 digits, the sum can't overflow before
+	// 10^15 rows, the generic path checks its sums.
+	count int64
+	sum   int64 // sum of the values multiplied by 10^Schema.Scale
 }
 
 type Entry struct {
 	name  []byte
 	value *Aggregation
+	// With a schema other than schema.Default, the row of the (station, window) pair in the columns
+	index  int
+	window int64
+	hash   uint64
+
+	// canonical is the name the entry is merged under with Options.Canonical, nil without it
+	canonical []byte
+}
+
+// key is the name the entry is merged under.
+func (e *Entry) key() []byte {
+	if e.canonical != nil {
+		return e.canonical
+	}
+	return e.name
 }
 
 func main() {
+	if bench.Requested() {
+		bench.Run(func(filename string) error {
+			_, err := Aggregate(filename)
+			return err
+		})
+		return
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	profFile, err := os.Create("cpu.prof")
 	if err != nil {
 		panic(fmt.Errorf("cannot create prof file: %w", err))
@@ -56,172 +101,519 @@ func main() {
 	}
 }
 
+// Options tunes AggregateContext, the zero value gives the behavior of Aggregate.
+type Options struct {
+	// Progress, if set, is called every ProgressInterval (default 1s) while the file is processed,
+	// and once more when it's done.
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+
+	// NumWorkers defaults to the number of CPU cores.
+	NumWorkers int
+	// ChunkSize is the size of the pieces the file is cut into, workers take them one by one
+	// from a shared cursor. Defaults to defaultChunkSize.
+	ChunkSize int64
+
+	// Schema of the file, the zero value means schema.Default.
+	Schema schema.Schema
+	// Window groups the rows of each station in tumbling windows, by the timestamp column of Schema.
+	// Only AggregateMetrics supports it.
+	Window Window
+	// Filter, if set, drops rows while parsing. Its Filtered counts are reset and filled in.
+	// Names are filtered as they're written in the file, not canonicalized. Rows go through the generic path.
+	Filter *Filter
+	// Canonical, if set, aggregates the spellings of a station under its canonical name. Rows go through the
+	// generic path.
+	Canonical *Canonical
+	// Limits, if set, fails on the first row out of them with a *LimitError. Rows dropped by Filter aren't checked.
+	// Values are then parsed by the generic path, which checks their syntax, instead of trusted by the hot path.
+	Limits *Limits
+	// Encoding of the file, the zero value is UTF-8. Offsets in errors and anomalies of files in other encodings are
+	// the offset of the chunk in the file plus the one of the line in the UTF-8 text of the chunk.
+	Encoding Encoding
+	// Lines, if set, tells how lines are written. Without it the start of the file is sniffed, files of plain
+	// "\n" lines get the hot path and the others the generic one.
+	Lines *LineFormat
+
+	// percentiles makes aggregateColumns keep the histograms of the stations, for RunQuery
+	percentiles bool
+}
+
 func Aggregate(filename string) (map[string]*Aggregation, error) {
+	return AggregateContext(context.Background(), filename, Options{})
+}
+
+// AggregateContext stops every worker as soon as ctx is done or one of them fails.
+// The returned error tells which part failed.
+func AggregateContext(ctx context.Context, filename string, opts Options) (map[string]*Aggregation, error) {
+	sch, err := opts.schema()
+	if err != nil {
+		return nil, err
+	}
+	if sch.NumColumns() > 1 {
+		return nil, fmt.Errorf("schema has %d value columns, use AggregateMetrics", sch.NumColumns())
+	}
+	if opts.Window != WindowNone {
+		return nil, errors.New("windows need AggregateMetrics")
+	}
+	lines, err := opts.lines(filename)
+	if err != nil {
+		return nil, err
+	}
+	opts.Lines = &lines
+	if opts.generic(sch, lines) {
+		keys, columns, err := aggregateColumns(ctx, filename, opts, sch)
+		if err != nil {
+			return nil, err
+		}
+		return columns[0].toAggregations(keys, sch.Divisor()), nil
+	}
+
+	agg := make(map[string]*Aggregation, 10000)
+	err = runWorkers(ctx, filename, opts, sch, func(a *chunkAggregator) {
+		for _, entry := range a.entries() {
+			mergeInto(agg, entry.key(), entry.value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range agg {
+		a.Mean = float64(a.sum) / float64(a.count) / sch.Divisor()
+	}
+
+	return agg, nil
+}
+
+// generic reports whether files in sch written as lines go through the generic path with these options. The hot path
+// only reads the challenge format in plain lines, trusts its values and has no per-row branch for any option.
+func (o Options) generic(sch schema.Schema, lines LineFormat) bool {
+	return !sch.IsDefault() || !lines.plain() || o.Filter != nil || o.Limits != nil || o.Canonical != nil
+}
+
+// schema returns the schema of the options, checked and with the zero value replaced by schema.Default.
+func (o Options) schema() (schema.Schema, error) {
+	sch := o.Schema
+	if sch.IsZero() {
+		sch = schema.Default
+	}
+	if err := sch.Validate(); err != nil {
+		return schema.Schema{}, fmt.Errorf("invalid schema: %w", err)
+	}
+	if o.Window != WindowNone && sch.Time == schema.TimeNone {
+		return schema.Schema{}, errors.New("windows need a timestamp column in the schema")
+	}
+	return sch, nil
+}
+
+// runWorkers cuts filename into chunks that workers aggregate with sch, and calls collect with the aggregator of
+// every worker once it's done. collect is only called from the calling goroutine.
+func runWorkers(ctx context.Context, filename string, opts Options, sch schema.Schema, collect func(*chunkAggregator)) error {
+	var filter *rowFilter
+	if opts.Filter != nil {
+		filter = newRowFilter(opts.Filter, sch)
+		opts.Filter.Filtered = FilterCounts{}
+	}
+
+	var limits *rowLimits
+	if opts.Limits != nil {
+		var err error
+		if limits, err = newRowLimits(opts.Limits, sch); err != nil {
+			return err
+		}
+	}
+	var aliases map[string]string
+	if opts.Canonical != nil {
+		aliases = canonicalAliases(opts.Canonical)
+	}
+	lines, err := opts.lines(filename)
+	if err != nil {
+		return err
+	}
+
+	newWorker := func() *chunkAggregator {
+		a := newChunkAggregator(sch, opts.Window, lines)
+		if a.columns == nil && opts.generic(sch, lines) {
+			a.columns = make([]metricColumn, sch.NumColumns())
+		}
+		a.filter = filter
+		a.limits = limits
+		if opts.Canonical != nil {
+			a.canonical = newCanonicalizer(opts.Canonical, aliases)
+		}
+		if opts.percentiles {
+			// Only the generic path keeps histograms
+			if a.columns == nil {
+				a.columns = make([]metricColumn, sch.NumColumns())
+			}
+			for c := range a.columns {
+				a.columns[c].percentiles = true
+			}
+		}
+		return a
+	}
+	work := func(ctx context.Context, a *chunkAggregator, _ int, part FilePart, r io.Reader, counter *partCounter) error {
+		r, skipped, err := openPart(r, part, opts.Encoding, counter)
+		if err != nil {
+			return err
+		}
+		a.offset = part.offset + skipped
+		return a.add(ctx, r, counter)
+	}
+	return runChunks(ctx, filename, opts, newWorker, work, func(a *chunkAggregator) {
+		if opts.Filter != nil {
+			opts.Filter.Filtered.add(a.filtered)
+		}
+		collect(a)
+	})
+}
+
+// runChunks cuts filename into chunks of opts.ChunkSize that opts.NumWorkers goroutines take one by one from a shared
+// cursor. Each worker gets its own state from newWorker, which work is called with for every chunk the worker takes,
+// and which is passed to collect once the worker is done. collect is only called from the calling goroutine.
+func runChunks[W any](ctx context.Context, filename string, opts Options, newWorker func() W,
+	work func(ctx context.Context, w W, i int, part FilePart, r io.Reader, counter *partCounter) error, collect func(W)) error {
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, fmt.Errorf("cannot open file: %w", err)
+		return fmt.Errorf("cannot open file: %w", err)
 	}
 	defer f.Close()
 
-	numWorkers := runtime.NumCPU() // Number of readers, set as the number of CPU cores
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get stat file: %w", err)
+	}
+
+	numWorkers := opts.NumWorkers
 	if numWorkers < 1 {
-		numWorkers = 16
+		numWorkers = runtime.NumCPU() // Number of readers, set as the number of CPU cores
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
 	}
 
-	FileParts, err := splitsFile(inputFile, numWorkers)
+	// Cut the file into many more chunks than workers, so a slow worker only holds back one small chunk
+	numChunks := max(1, int((stat.Size()+chunkSize-1)/chunkSize))
+	chunks, err := splitsFile(filename, numChunks, opts.Encoding.unit())
 	if err != nil {
-		return nil, fmt.Errorf("cannot spit file: %w", err)
+		return fmt.Errorf("cannot spit file: %w", err)
+	}
+	numWorkers = max(1, min(numWorkers, len(chunks)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	counters := make([]partCounter, len(chunks))
+	if opts.Progress != nil {
+		stop := reportProgress(chunks, counters, opts.ProgressInterval, opts.Progress)
+		defer stop()
 	}
 
 	type result struct {
-		entries []*Entry
-		err     error
+		worker W
+		err    error
 	}
-	resCh := make(chan *result, numWorkers+1)
+	resCh := make(chan *result, numWorkers)
 
 	go func() {
 		defer close(resCh)
 
 		var wg sync.WaitGroup
+		var next atomic.Int64 // index of the next chunk to take
 
-		for _, part := range FileParts {
-			r := io.NewSectionReader(f, part.offset, part.length)
-
+		for range numWorkers {
 			wg.Add(1)
-			go func(r io.Reader) {
+			go func() {
 				defer wg.Done()
 
-				e, err := aggregate(r)
-				if err != nil {
-					resCh <- &result{nil, err}
-					return
+				w := newWorker()
+				for {
+					i := int(next.Add(1) - 1)
+					if i >= len(chunks) {
+						break
+					}
+					part := chunks[i]
+					r := io.NewSectionReader(f, part.offset, part.length)
+					if err := work(ctx, w, i, part, r, &counters[i]); err != nil {
+						resCh <- &result{err: fmt.Errorf("failed to aggregate part %d (offset %d, length %d): %w", i, part.offset, part.length, err)}
+						return
+					}
 				}
-				resCh <- &result{entries: e, err: nil}
-			}(r)
+				resCh <- &result{worker: w}
+			}()
 		}
 
 		wg.Wait()
 	}()
 
-	agg := make(map[string]*Aggregation, 10000)
+	var firstErr error
 	for res := range resCh {
-		if res.err != nil {
-			return nil, res.err
-		}
-		if res.entries == nil {
+		// Keep draining after an error so every worker is done with the file before it gets closed
+		if firstErr != nil {
 			continue
 		}
-		for _, entry := range res.entries {
-			a, ok := agg[string(entry.name)]
-			if !ok {
-				agg[string(entry.name)] = entry.value
-				continue
-			}
-			a.Max = max(a.Max, entry.value.Max)
-			a.Min = min(a.Min, entry.value.Min)
-			a.sumX10 += entry.value.sumX10
-			a.count += entry.value.count
+		if res.err != nil {
+			firstErr = res.err
+			cancel()
+			continue
 		}
+		collect(res.worker)
 	}
+	return firstErr
+}
 
-	for _, a := range agg {
-		a.Mean = float64(a.sumX10) / float64(a.count) / 10
+// mergeInto merges the partial aggregation of a station into agg.
+// Mean is not touched, the caller computes it once everything is merged.
+func mergeInto(agg map[string]*Aggregation, name []byte, v *Aggregation) {
+	a, ok := agg[string(name)]
+	if !ok {
+		agg[string(name)] = v
+		return
 	}
+	a.Max = max(a.Max, v.Max)
+	a.Min = min(a.Min, v.Min)
+	a.sum += v.sum
+	a.count += v.count
+}
 
-	return agg, nil
+// aggregate processes r with the custom scanner and map, ctx is checked once per buffer. counter may be nil.
+func aggregate(ctx context.Context, r io.Reader, counter *partCounter) ([]*Entry, error) {
+	a := newChunkAggregator(schema.Default, WindowNone, LineFormat{})
+	if err := a.add(ctx, r, counter); err != nil {
+		return nil, err
+	}
+	return a.entries(), nil
 }
 
-func aggregate(r io.Reader) ([]*Entry, error) {
-	// Custom map
-	m := make([]*Entry, mapSize)
-	size := 0
+// chunkAggregator owns a custom map and a read buffer, a worker reuses it for every chunk it takes.
+// With schema.Default the map holds the statistics, with any other schema the entries point into columns.
+type chunkAggregator struct {
+	m       []*Entry
+	size    int
+	buf     []byte
+	schema  schema.Schema
+	columns []metricColumn
+	window  Window
+
+	// filter is nil without Options.Filter, matched and unmatched remember the stations its pattern was run on
+	filter    *rowFilter
+	filtered  FilterCounts
+	matched   nameSet
+	unmatched nameSet
+
+	// lines tells processColumns how lines are written, nameBuf holds the last quoted name with doubled quotes
+	lines   LineFormat
+	nameBuf []byte
+
+	// canonical is nil without Options.Canonical
+	canonical *canonicalizer
+	// limits is nil without Options.Limits, offset is the one of the chunk being processed in the file
+	limits *rowLimits
+	offset int64
+}
+
+func newChunkAggregator(s schema.Schema, w Window, l LineFormat) *chunkAggregator {
+	a := &chunkAggregator{
+		m:         make([]*Entry, mapSize),
+		buf:       make([]byte, scanBufSize),
+		schema:    s,
+		window:    w,
+		lines:     l,
+		matched:   make(nameSet),
+		unmatched: make(nameSet),
+	}
+	if !s.IsDefault() || !l.plain() {
+		a.columns = make([]metricColumn, s.NumColumns())
+	}
+	return a
+}
+
+// reset empties the aggregator for another reader, keeping its map, buffer and columns.
+func (a *chunkAggregator) reset() {
+	clear(a.m)
+	a.size = 0
+	a.offset = 0
+	for c := range a.columns {
+		a.columns[c].reset()
+	}
+}
+
+func (a *chunkAggregator) add(ctx context.Context, r io.Reader, counter *partCounter) error {
+	// The challenge format in plain lines without options gets the integer-only hot path, anything else the generic one
+	process := a.processDefault
+	if a.columns != nil {
+		process = a.processColumns
+	}
+	return scanLines(ctx, r, &a.buf, counter, func(chunk []byte) (int64, error) {
+		rows, err := process(chunk)
+		a.offset += int64(len(chunk))
+		return rows, err
+	})
+}
+
+// scanLines reads r into *buf and calls process with every run of complete lines, *buf is grown to fit long lines.
+// process returns the number of rows it read, for counter, which may be nil.
+func scanLines(ctx context.Context, r io.Reader, buf *[]byte, counter *partCounter, process func(chunk []byte) (int64, error)) error {
 	// Custom Scanner to read the file
-	buf := make([]byte, scanBufSize)
 	readStart := 0
 	done := false
+	zeroReads := 0
 
 	for !done {
-		n, err := r.Read(buf[readStart:])
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if readStart == len(*buf) {
+			// The buffer is full without a single newline, grow it to fit the line
+			if len(*buf) >= maxScanBufSize {
+				return fmt.Errorf("line longer than %d bytes", maxScanBufSize)
+			}
+			*buf = append(*buf, make([]byte, len(*buf))...)
+		}
+
+		n, err := r.Read((*buf)[readStart:])
 		if err != nil {
 			if err != io.EOF {
-				return nil, fmt.Errorf("failed to read file: %w", err)
+				return fmt.Errorf("failed to read file: %w", err)
 			}
 			done = true
 		}
+		if n == 0 && !done {
+			// Readers may return nothing without an error, but not forever
+			zeroReads++
+			if zeroReads >= maxZeroReads {
+				return io.ErrNoProgress
+			}
+			continue
+		}
+		zeroReads = 0
 		length := readStart + n
 
-		// According the the spec, we know the length of each line is no longer than 1 MB.
-		chunk := buf[:bytes.LastIndexByte(buf[:length], '\n')+1] // Include the newline character
+		// Terminate a last line that has no newline, so it's not dropped
+		virtualNewline := 0
+		if done && length > 0 && (*buf)[length-1] != '\n' {
+			if length == len(*buf) {
+				*buf = append(*buf, '\n')
+			}
+			(*buf)[length] = '\n'
+			length++
+			virtualNewline = 1
+		}
 
-		for i := 0; i < len(chunk); {
-			// Find the station name and calculate the hash on the way
-			hash := uint64(fnvOffset)
-			start := i
-			for ; chunk[i] != ';'; i++ {
-				hash ^= uint64(chunk[i])
-				hash *= uint64(fnvPrime)
+		b := *buf
+		chunk := b[:bytes.LastIndexByte(b[:length], '\n')+1] // Include the newline character
+		rows, err := process(chunk)
+		if err != nil {
+			return err
+		}
+		if counter != nil {
+			counter.add(int64(len(chunk)-virtualNewline), rows)
+		}
+
+		copy(b, b[len(chunk):length])
+		readStart = length - len(chunk)
+	}
+
+	return nil
+}
+
+// processDefault aggregates the complete lines of chunk written in schema.Default, without any option.
+func (a *chunkAggregator) processDefault(chunk []byte) (int64, error) {
+	// Custom map
+	m := a.m
+	size := a.size
+	defer func() { a.size = size }()
+
+	rows := int64(0)
+
+	for i := 0; i < len(chunk); {
+		// Find the station name and calculate the hash on the way
+		hash := uint64(fnvOffset)
+		start := i
+		for ; chunk[i] != ';'; i++ {
+			if chunk[i] == '\n' {
+				// Without this check we'd run past the end of the chunk
+				return 0, fmt.Errorf("missing separator in line %q", chunk[start:i])
 			}
-			name := chunk[start:i]
-			i++ // Skip the newline character
-
-			// Calculate the value
-			valX10 := 0
-			negative := false
-			for ; chunk[i] != '\n'; i++ {
-				if chunk[i] == '-' {
-					negative = true
-					continue
-				}
-				if chunk[i] == '.' {
-					continue
-				}
-				valX10 = valX10*10 + int(chunk[i]-'0')
+			hash ^= uint64(chunk[i])
+			hash *= uint64(fnvPrime)
+		}
+		name := chunk[start:i]
+		i++ // Skip the newline character
+
+		// Calculate the value
+		valStart := i
+		valX10 := 0
+		negative := false
+		for ; chunk[i] != '\n'; i++ {
+			if chunk[i] == '-' {
+				negative = true
+				continue
 			}
-			i++ // Skip the newline character
-			if negative {
-				valX10 = -valX10
+			if chunk[i] == '.' {
+				continue
 			}
-			val := float64(valX10) / 10
-
-			// Set value into the map
-			bucket := hash & mapMask
-			for ; ; bucket++ {
-				e := m[bucket]
-				if e == nil {
-					// Empty slot, insert here
-					m[bucket] = &Entry{
-						name:  make([]byte, len(name)),
-						value: &Aggregation{Min: val, Max: val, sumX10: valX10, count: 1},
-					}
-					copy(m[bucket].name, name)
-					size++
-					if size >= maxLoad {
-						panic("custom map exceeded maximum load factor")
-					}
-					break
+			valX10 = valX10*10 + int(chunk[i]-'0')
+		}
+		if i-valStart < 3 || chunk[i-2] != '.' {
+			// Any other scale would be read wrong, "1.23" as 12.3, and so would a CRLF past what SniffLines read
+			return 0, defaultValueError(chunk[start:i], chunk[valStart:i])
+		}
+		i++ // Skip the newline character
+		if negative {
+			valX10 = -valX10
+		}
+		rows++
+		val := float64(valX10) / 10
+
+		// Set value into the map
+		bucket := hash & mapMask
+		for ; ; bucket = (bucket + 1) & mapMask {
+			e := m[bucket]
+			if e == nil {
+				// Empty slot, insert here
+				m[bucket] = &Entry{
+					name:  make([]byte, len(name)),
+					value: &Aggregation{Min: val, Max: val, sum: int64(valX10), count: 1},
 				}
-				if bytes.Equal(e.name, name) {
-					// Key already exists, update value
-					e.value.Max = max(e.value.Max, val)
-					e.value.Min = min(e.value.Min, val)
-					e.value.sumX10 += valX10
-					e.value.count++
-					break
+				copy(m[bucket].name, name)
+				size++
+				if size >= maxLoad {
+					panic("custom map exceeded maximum load factor")
 				}
+				break
+			}
+			if bytes.Equal(e.name, name) {
+				// Key already exists, update value
+				e.value.Max = max(e.value.Max, val)
+				e.value.Min = min(e.value.Min, val)
+				e.value.sum += int64(valX10)
+				e.value.count++
+				break
 			}
 		}
+	}
+	return rows, nil
+}
 
-		copy(buf, buf[len(chunk):length])
-		readStart = length - len(chunk)
+// defaultValueError is the error of a value the hot path can't read in line, which isn't given its newline character.
+func defaultValueError(line, value []byte) error {
+	if bytes.HasSuffix(line, []byte{'\r'}) {
+		return crlfError(line)
 	}
+	return fmt.Errorf("invalid value %q in line %q, expected exactly one fractional digit", value, line)
+}
 
-	agg := make([]*Entry, 0, len(m))
-	for _, e := range m {
+func (a *chunkAggregator) entries() []*Entry {
+	agg := make([]*Entry, 0, a.size)
+	for _, e := range a.m {
 		if e == nil {
 			continue
 		}
 		agg = append(agg, e)
 	}
-
-	return agg, nil
+	return agg
 }
@@ -1,12 +1,38 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/minhtri06/1brc/bench"
+	"github.com/minhtri06/1brc/query"
+	"github.com/minhtri06/1brc/reference"
+	"github.com/minhtri06/1brc/schema"
 	"github.com/minhtri06/1brc/writeresult"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
 )
 
 func TestAggregate(t *testing.T) {
@@ -41,6 +67,1663 @@ func TestAggregate(t *testing.T) {
 	}
 
 	if string(expected) != string(actual) {
-		t.Errorf("output mismatch\nExpected:\n%s\nActual:\n%s", expected, actual)
+		t.Errorf("output mismatch\n%s", writeresult.DiffOutputs(string(expected), string(actual)))
 	}
 }
+
+func TestDistributed(t *testing.T) {
+	inputFile := "../measurements_small.txt"
+
+	expected, err := Aggregate(inputFile)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	c, err := newCoordinator(inputFile, 8, 200*time.Millisecond, Options{})
+	if err != nil {
+		t.Fatalf("newCoordinator failed: %v", err)
+	}
+	srv := httptest.NewServer(c.handler())
+	defer srv.Close()
+
+	// A worker that claims a part and dies, the part must be handed out again once the lease expires
+	if _, err := claimTask(context.Background(), srv.Client(), srv.URL); err != nil {
+		t.Fatalf("claimTask failed: %v", err)
+	}
+
+	agg, err := runDistributed(t, c, srv)
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	if !reflect.DeepEqual(toResult(expected), toResult(agg)) {
+		t.Errorf("distributed result mismatch\nExpected:\n%v\nActual:\n%v", toResult(expected), toResult(agg))
+	}
+}
+
+func TestDistributedInput(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+	// The measurements in UTF-16LE with a byte order mark and CRLF, read with two decimals
+	encoded, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes(bytes.ReplaceAll(input, []byte("\n"), []byte("\r\n")))
+	if err != nil {
+		t.Fatalf("cannot encode input: %v", err)
+	}
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, encoded, 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	sch := schema.Schema{Separator: ';', Scale: 2, Signs: schema.SignMinus}
+	opts := Options{Schema: sch, Encoding: EncodingUTF16LE}
+	expected, err := AggregateContext(context.Background(), inputFile, opts)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	c, err := newCoordinator(inputFile, 8, time.Minute, opts)
+	if err != nil {
+		t.Fatalf("newCoordinator failed: %v", err)
+	}
+	srv := httptest.NewServer(c.handler())
+	defer srv.Close()
+	agg, err := runDistributed(t, c, srv)
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	if !reflect.DeepEqual(formatResult(expected, sch), formatResult(agg, sch)) {
+		t.Errorf("distributed result mismatch\nExpected:\n%v\nActual:\n%v", formatResult(expected, sch), formatResult(agg, sch))
+	}
+}
+
+func TestDistributedFailingPart(t *testing.T) {
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, []byte("Abha;1.0\nno separator\nAden;2.0\n"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	c, err := newCoordinator(inputFile, 1, time.Minute, Options{})
+	if err != nil {
+		t.Fatalf("newCoordinator failed: %v", err)
+	}
+	srv := httptest.NewServer(c.handler())
+	defer srv.Close()
+
+	// Every attempt fails the same way, the job fails once the part is out of attempts instead of retrying forever
+	_, err = runDistributed(t, c, srv)
+	if err == nil || !strings.Contains(err.Error(), "missing separator") {
+		t.Errorf("got error %v, expected the missing separator of the worker", err)
+	}
+	if c.tasks[0].failures != maxTaskFailures {
+		t.Errorf("part failed %d times, expected %d", c.tasks[0].failures, maxTaskFailures)
+	}
+}
+
+func TestDistributedKilledWorker(t *testing.T) {
+	inputFile := "../measurements_small.txt"
+	expected, err := Aggregate(inputFile)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	c, err := newCoordinator(inputFile, 1, 200*time.Millisecond, Options{})
+	if err != nil {
+		t.Fatalf("newCoordinator failed: %v", err)
+	}
+	srv := httptest.NewServer(c.handler())
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A worker process that claims the only part, then gets killed in the middle of it
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDistributedWorkerProcess$")
+	cmd.Env = append(os.Environ(), "S9_TEST_COORDINATOR="+srv.URL)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("cannot get the output of the worker: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("cannot start the worker: %v", err)
+	}
+	line, err := bufio.NewReader(out).ReadString('\n')
+	var deadLease int
+	if _, scanErr := fmt.Sscanf(line, "claimed %d", &deadLease); err != nil || scanErr != nil {
+		t.Fatalf("worker didn't claim the part: %q, %v, %v", line, err, scanErr)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	// The part is retried under a new lease once the one of the dead worker expires
+	var retry *task
+	for retry == nil || retry.ID < 0 {
+		if retry, err = claimTask(ctx, srv.Client(), srv.URL); err != nil || retry == nil {
+			t.Fatalf("claimTask: got %v, %v, expected the part again", retry, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if retry.Lease == deadLease {
+		t.Fatalf("part handed out again under the lease %d of the dead worker", deadLease)
+	}
+
+	// A report under the dead lease, as a hung worker waking up would send, neither counts as a failure nor gives
+	// the part back while the retry holds it
+	if err := postResult(ctx, srv.Client(), srv.URL, &partialResult{TaskID: 0, Lease: deadLease, Error: "stale"}); err != nil {
+		t.Fatalf("postResult failed: %v", err)
+	}
+	c.mu.Lock()
+	failures, state := c.tasks[0].failures, c.tasks[0].state
+	c.mu.Unlock()
+	if failures != 0 || state != taskLeased {
+		t.Errorf("after a stale report the part has %d failures and state %d, expected 0 and leased", failures, state)
+	}
+
+	entries, err := aggregateTask(ctx, retry)
+	if err != nil {
+		t.Fatalf("aggregateTask failed: %v", err)
+	}
+	if err := postResult(ctx, srv.Client(), srv.URL, &partialResult{TaskID: 0, Lease: retry.Lease, Entries: entries}); err != nil {
+		t.Fatalf("postResult failed: %v", err)
+	}
+	agg, err := c.wait(ctx)
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	if !reflect.DeepEqual(toResult(expected), toResult(agg)) {
+		t.Errorf("distributed result mismatch\nExpected:\n%v\nActual:\n%v", toResult(expected), toResult(agg))
+	}
+}
+
+// TestDistributedWorkerProcess is the worker TestDistributedKilledWorker starts in its own process and kills.
+func TestDistributedWorkerProcess(t *testing.T) {
+	url := os.Getenv("S9_TEST_COORDINATOR")
+	if url == "" {
+		t.Skip("only run by TestDistributedKilledWorker")
+	}
+	claimed, err := claimTask(context.Background(), http.DefaultClient, url)
+	if err != nil || claimed == nil || claimed.ID < 0 {
+		t.Fatalf("claimTask: got %v, %v, expected a part", claimed, err)
+	}
+	fmt.Printf("claimed %d\n", claimed.Lease)
+
+	// Stuck in the middle of the part: read half of it, then wait to be killed
+	f, err := os.Open(claimed.File)
+	if err != nil {
+		t.Fatalf("cannot open file: %v", err)
+	}
+	defer f.Close()
+	io.CopyN(io.Discard, io.NewSectionReader(f, claimed.Offset, claimed.Length), claimed.Length/2)
+	time.Sleep(time.Minute)
+}
+
+// runDistributed runs 3 workers against the coordinator c served by srv and waits for the job.
+func runDistributed(t *testing.T, c *coordinator, srv *httptest.Server) (map[string]*Aggregation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errCh := make(chan error, 3)
+	for range 3 {
+		go func() { errCh <- runWorker(ctx, srv.URL, srv.Client()) }()
+	}
+
+	agg, err := c.wait(ctx)
+	for range 3 {
+		if err := <-errCh; err != nil {
+			t.Errorf("worker failed: %v", err)
+		}
+	}
+	return agg, err
+}
+
+func TestServer(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+	expected, err := os.ReadFile("../output_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read expected output: %v", err)
+	}
+
+	srv := httptest.NewServer(newServer(int64(len(input))).handler())
+	defer srv.Close()
+
+	post := func(path string, body []byte) *http.Response {
+		resp, err := http.Post(srv.URL+path, "text/plain", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Split on a line boundary, and drop the final newline, the server must cope with both
+	half := bytes.IndexByte(input[len(input)/2:], '\n') + len(input)/2 + 1
+	post("/measurements", input[:half])
+	post("/measurements", bytes.TrimSuffix(input[half:], []byte("\n")))
+
+	// Bodies come from devices, their values are checked rather than read digit by digit
+	for _, body := range []string{"no separator here\n", "Abha;x\n", "Abha;1.23\n", "Oslo;5-5\n", "Abha;1.0\r\n"} {
+		if resp := post("/measurements", []byte(body)); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("malformed body %q: expected status 400, got %v", body, resp.StatusCode)
+		}
+	}
+	// Rejected whole, or the result below would count the first rows twice
+	if resp := post("/measurements", append(input, "Abha;1.0\n"...)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: expected status 413, got %v", resp.StatusCode)
+	}
+
+	if _, actual := get("/result?format=text"); actual != string(expected) {
+		t.Errorf("output mismatch\n%s", writeresult.DiffOutputs(string(expected), string(actual)))
+	}
+	if status, _ := get("/stations/Abha"); status != http.StatusOK {
+		t.Errorf("GET /stations/Abha: expected status 200, got %v", status)
+	}
+	if status, _ := get("/stations/Atlantis"); status != http.StatusNotFound {
+		t.Errorf("GET /stations/Atlantis: expected status 404, got %v", status)
+	}
+
+	post("/reset", nil)
+	if _, body := get("/stations"); strings.TrimSpace(body) != "[]" {
+		t.Errorf("expected no stations after reset, got %s", body)
+	}
+
+	// A last line without a newline nor a fractional digit is still 1.0, not 0.1
+	post("/measurements", []byte("Abha;1"))
+	if _, body := get("/result"); strings.TrimSpace(body) != "{Abha=1.0/1.0/1.0}" {
+		t.Errorf("got %s, expected {Abha=1.0/1.0/1.0}", body)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var reports []Progress
+	_, err := AggregateContext(context.Background(), "../measurements_small.txt", Options{
+		Progress:         func(p Progress) { reports = append(reports, p) },
+		ProgressInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	stat, err := os.Stat("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to stat input: %v", err)
+	}
+
+	last := reports[len(reports)-1]
+	if !last.Done {
+		t.Errorf("expected the last report to be done")
+	}
+	if last.Bytes != stat.Size() || last.TotalBytes != stat.Size() {
+		t.Errorf("expected %v bytes processed, got %v of %v", stat.Size(), last.Bytes, last.TotalBytes)
+	}
+	if last.Rows != 1000 {
+		t.Errorf("expected 1000 rows, got %v", last.Rows)
+	}
+}
+
+func TestAggregateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := AggregateContext(ctx, "../measurements_small.txt", Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "part") {
+		t.Errorf("expected the error to identify the failed part, got %v", err)
+	}
+}
+
+func TestAggregateSmallChunks(t *testing.T) {
+	expected, err := Aggregate("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	for _, numWorkers := range []int{1, 3, 64} {
+		agg, err := AggregateContext(context.Background(), "../measurements_small.txt", Options{NumWorkers: numWorkers, ChunkSize: 1024})
+		if err != nil {
+			t.Fatalf("aggregate with %d workers failed: %v", numWorkers, err)
+		}
+		if !reflect.DeepEqual(toResult(expected), toResult(agg)) {
+			t.Errorf("result mismatch with %d workers\nExpected:\n%v\nActual:\n%v", numWorkers, toResult(expected), toResult(agg))
+		}
+	}
+}
+
+func TestAggregateReaders(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"OneByteReader": iotest.OneByteReader,
+		"HalfReader":    iotest.HalfReader,
+		"DataErrReader": iotest.DataErrReader,
+		"emptyReads":    func(r io.Reader) io.Reader { return &emptyReadsReader{r: r} },
+	}
+	for name, wrap := range readers {
+		t.Run(name, func(t *testing.T) {
+			entries, err := aggregate(context.Background(), wrap(bytes.NewReader(input)), nil)
+			if err != nil {
+				t.Fatalf("aggregate failed: %v", err)
+			}
+			checkAgainstReference(t, input, entries)
+		})
+	}
+}
+
+func TestAggregateReadError(t *testing.T) {
+	_, err := aggregate(context.Background(), iotest.TimeoutReader(strings.NewReader("Abha;12.3\nAbha;1.0\n")), nil)
+	if !errors.Is(err, iotest.ErrTimeout) {
+		t.Errorf("expected iotest.ErrTimeout, got %v", err)
+	}
+
+	_, err = aggregate(context.Background(), &emptyReadsReader{r: strings.NewReader("Abha;12.3\n"), always: true}, nil)
+	if !errors.Is(err, io.ErrNoProgress) {
+		t.Errorf("expected io.ErrNoProgress, got %v", err)
+	}
+}
+
+func TestAggregateLongLines(t *testing.T) {
+	long := strings.Repeat("A", 3*scanBufSize)
+	data := []byte("Abha;12.3\n" + long + ";-1.0\nAbha;1.0") // no trailing newline either
+	entries, err := aggregate(context.Background(), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"Abha": reference.Line(1.0, 6.7, 12.3, 2),
+		long:   reference.Line(-1.0, -1.0, -1.0, 1),
+	}
+	actual := map[string]string{}
+	for _, e := range entries {
+		mean := float64(e.value.sum) / float64(e.value.count) / 10
+		actual[string(e.name)] = reference.Line(e.value.Min, mean, e.value.Max, e.value.count)
+	}
+	if diff := reference.Diff(expected, actual); diff != "" {
+		t.Errorf("result mismatch\n%s", diff)
+	}
+}
+
+// emptyReadsReader returns 0, nil before every read of r, or always when set.
+type emptyReadsReader struct {
+	r      io.Reader
+	always bool
+	empty  bool
+}
+
+func (e *emptyReadsReader) Read(p []byte) (int, error) {
+	e.empty = !e.empty
+	if e.empty || e.always {
+		return 0, nil
+	}
+	return e.r.Read(p)
+}
+
+func TestAggregateSchema(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+	expected, err := Aggregate("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	// Same measurements as "Name|+12.30" with two decimals and an explicit plus, names contain commas
+	var converted bytes.Buffer
+	for _, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+		name, val, _ := strings.Cut(line, ";")
+		if !strings.HasPrefix(val, "-") {
+			val = "+" + val
+		}
+		fmt.Fprintf(&converted, "%s|%s0\n", name, val)
+	}
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, converted.Bytes(), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	sch := schema.Schema{Separator: '|', Scale: 2, Signs: schema.SignMinus | schema.SignPlus}
+	agg, err := AggregateContext(context.Background(), inputFile, Options{Schema: sch})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if len(agg) != len(expected) {
+		t.Fatalf("got %d stations, expected %d", len(agg), len(expected))
+	}
+	for name, e := range expected {
+		a := agg[name]
+		if a == nil || a.Min != e.Min || a.Max != e.Max || a.sum != e.sum*10 || a.count != e.count {
+			t.Errorf("station %q: got %+v, expected %+v", name, a, e)
+		}
+	}
+
+	// A plus sign is an error unless the schema allows it
+	sch.Signs = schema.SignMinus
+	if _, err := AggregateContext(context.Background(), inputFile, Options{Schema: sch}); err == nil {
+		t.Error("expected an error for a leading plus")
+	}
+}
+
+func TestAggregateSchemaIntegers(t *testing.T) {
+	inputFile := filepath.Join(t.TempDir(), "input.tsv")
+	if err := os.WriteFile(inputFile, []byte("Abha\t12\nAbha\t-3\nOslo\t0\n"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	sch := schema.Schema{Separator: '\t', Scale: 0, Signs: schema.SignMinus}
+	agg, err := AggregateContext(context.Background(), inputFile, Options{Schema: sch})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	expected := map[string]string{"Abha": "-3.0/4.5/12.0", "Oslo": "0.0/0.0/0.0"}
+	if actual := formatResult(agg, sch); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestDefaultScale(t *testing.T) {
+	// The hot path reads digits whatever the point is, values of another scale must be errors rather than 12.3 or 0.1
+	for _, line := range []string{"Abha;1.23", "Abha;1", "Abha;"} {
+		inputFile := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(inputFile, []byte("Abha;12.3\n"+line+"\n"), 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+		if _, err := Aggregate(inputFile); err == nil || !strings.Contains(err.Error(), "one fractional digit") {
+			t.Errorf("%q: expected an invalid value error, got %v", line, err)
+		}
+	}
+}
+
+func TestAggregateMetrics(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+	expected, err := Aggregate("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	// "Name;temp;humidity;pressure" with humidity the negated temperature, and pressure only measured in Abha
+	var converted bytes.Buffer
+	for _, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+		name, val, _ := strings.Cut(line, ";")
+		negated := "-" + val
+		if strings.HasPrefix(val, "-") {
+			negated = val[1:]
+		}
+		pressure := ""
+		if name == "Abha" {
+			pressure = "1013.2"
+		}
+		fmt.Fprintf(&converted, "%s;%s;%s;%s\n", name, val, negated, pressure)
+	}
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, converted.Bytes(), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	sch := schema.Default
+	sch.Columns = []string{"temp", "humidity", "pressure"}
+	table, err := AggregateMetrics(context.Background(), inputFile, Options{Schema: sch, NumWorkers: 3, ChunkSize: 1024})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if len(table.Stations) != len(expected) || len(table.Metrics) != 3 {
+		t.Fatalf("got %d stations and %d metrics, expected %d and 3", len(table.Stations), len(table.Metrics), len(expected))
+	}
+	temp, humidity, pressure := table.Metrics[0], table.Metrics[1], table.Metrics[2]
+	for i, name := range table.Stations {
+		e := expected[name]
+		if e == nil {
+			t.Fatalf("unexpected station %q", name)
+		}
+		if temp.Min[i] != e.Min || temp.Max[i] != e.Max || temp.Count[i] != e.count {
+			t.Errorf("temp of %q: got %v/%v/%v, expected %+v", name, temp.Min[i], temp.Max[i], temp.Count[i], e)
+		}
+		if humidity.Min[i] != -e.Max || humidity.Max[i] != -e.Min || humidity.Count[i] != e.count {
+			t.Errorf("humidity of %q: got %v/%v/%v, expected the negated %+v", name, humidity.Min[i], humidity.Max[i], humidity.Count[i], e)
+		}
+		if name == "Abha" {
+			if pressure.Mean[i] != 1013.2 || pressure.Count[i] != e.count {
+				t.Errorf("pressure of Abha: got %v (%v rows)", pressure.Mean[i], pressure.Count[i])
+			}
+		} else if pressure.Count[i] != 0 {
+			t.Errorf("pressure of %q: got %v rows, expected none", name, pressure.Count[i])
+		}
+	}
+
+	names, res := formatMetrics(table, sch)
+	if !reflect.DeepEqual(names, sch.Columns) || len(res[2]) != 1 || res[0]["Abha"] != toResult(expected)["Abha"] {
+		t.Errorf("unexpected formatted metrics %v: %v", names, res)
+	}
+}
+
+func TestAggregateMetricsColumnCount(t *testing.T) {
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, []byte("Abha;1.0;2.0\nAbha;1.0\n"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	sch := schema.Default
+	sch.Columns = []string{"temp", "humidity"}
+	_, err := AggregateMetrics(context.Background(), inputFile, Options{Schema: sch})
+	if err == nil || !strings.Contains(err.Error(), "2 value columns") {
+		t.Errorf("expected an error about the number of columns, got %v", err)
+	}
+
+	// A single column schema goes through the hot path
+	table, err := AggregateMetrics(context.Background(), "../measurements_small.txt", Options{})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if len(table.Metrics) != 1 || table.Metrics[0].Name != "value" || len(table.Stations) != len(table.Metrics[0].Mean) {
+		t.Errorf("unexpected single metric table %+v", table.Metrics)
+	}
+}
+
+func TestAggregateWindows(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+
+	// Spread the rows over a few months, every station gets rows in many days
+	type key struct {
+		name string
+		day  string
+	}
+	expected := map[key]*reference.Stats{}
+	var converted bytes.Buffer
+	start := time.Date(2026, 8, 30, 22, 0, 0, 0, time.UTC)
+	for i, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+		name, val, _ := strings.Cut(line, ";")
+		ts := start.Add(time.Duration(i*7919) * time.Second)
+		if i%2 == 0 {
+			fmt.Fprintf(&converted, "%s;%s;%s\n", name, ts.Format(time.RFC3339), val)
+		} else {
+			fmt.Fprintf(&converted, "%s;%s;%s\n", name, ts.In(time.FixedZone("", 5*3600)).Format(time.RFC3339), val)
+		}
+
+		_, v, _ := reference.ParseLine(line)
+		k := key{name, ts.Format("2006-01-02")}
+		if expected[k] == nil {
+			expected[k] = &reference.Stats{Min: v, Max: v}
+		}
+		expected[k].Min, expected[k].Max = min(expected[k].Min, v), max(expected[k].Max, v)
+		expected[k].SumX10 += reference.ValX10(v)
+		expected[k].Count++
+	}
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, converted.Bytes(), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	sch := schema.Default
+	sch.Time = schema.TimeRFC3339
+	table, err := AggregateMetrics(context.Background(), inputFile, Options{Schema: sch, Window: WindowDay, NumWorkers: 4, ChunkSize: 2048})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if len(table.Stations) != len(expected) {
+		t.Fatalf("got %d rows, expected %d", len(table.Stations), len(expected))
+	}
+	m := table.Metrics[0]
+	for i, name := range table.Stations {
+		if i > 0 && name == table.Stations[i-1] && !table.Windows[i].After(table.Windows[i-1]) {
+			t.Errorf("windows of %q are not in chronological order: %v then %v", name, table.Windows[i-1], table.Windows[i])
+		}
+		e := expected[key{name, WindowDay.label(table.Windows[i])}]
+		if e == nil {
+			t.Fatalf("unexpected window %v of %q", table.Windows[i], name)
+		}
+		if m.Min[i] != e.Min || m.Max[i] != e.Max || m.Count[i] != e.Count || math.Abs(m.Mean[i]-e.Mean()) > 1e-9 {
+			t.Errorf("window %v of %q: got %v/%v/%v (%v rows), expected %+v", table.Windows[i], name, m.Min[i], m.Mean[i], m.Max[i], m.Count[i], e)
+		}
+	}
+
+	if _, err := AggregateContext(context.Background(), inputFile, Options{Schema: sch, Window: WindowDay}); err == nil {
+		t.Error("expected AggregateContext to refuse windows")
+	}
+	if _, err := AggregateMetrics(context.Background(), inputFile, Options{Window: WindowDay}); err == nil {
+		t.Error("expected an error for windows without a timestamp column")
+	}
+}
+
+func TestAggregateManyWindows(t *testing.T) {
+	// More (station, window) pairs than the custom map holds before growing
+	var data bytes.Buffer
+	const hours = mapSize
+	for i := range hours {
+		fmt.Fprintf(&data, "Abha;%d;%d\n", i*3600+59, i%100)
+	}
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, data.Bytes(), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	sch := schema.Schema{Separator: ';', Scale: 0, Signs: schema.SignMinus, Time: schema.TimeUnix}
+	table, err := AggregateMetrics(context.Background(), inputFile, Options{Schema: sch, Window: WindowHour, NumWorkers: 2})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if len(table.Windows) != hours {
+		t.Fatalf("got %d windows, expected %d", len(table.Windows), hours)
+	}
+	for i, start := range table.Windows {
+		if start.Unix() != int64(i*3600) || table.Metrics[0].Mean[i] != float64(i%100) {
+			t.Fatalf("window %d: got %v with mean %v", i, start, table.Metrics[0].Mean[i])
+		}
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	ts := time.Date(2026, 10, 19, 12, 34, 56, 0, time.UTC).Unix()
+	tests := []struct {
+		w     Window
+		sec   int64
+		label string
+	}{
+		{WindowHour, ts, "2026-10-19T12"},
+		{WindowDay, ts, "2026-10-19"},
+		{WindowMonth, ts, "2026-10"},
+		{WindowDay, -1, "1969-12-31"},
+		{WindowMonth, -1, "1969-12"},
+	}
+	for _, tt := range tests {
+		start := tt.w.start(tt.sec)
+		if label := tt.w.label(time.Unix(start, 0)); label != tt.label || start > tt.sec {
+			t.Errorf("window %d of %d: got start %d (%s), expected %s", tt.w, tt.sec, start, label, tt.label)
+		}
+	}
+}
+
+func TestRollup(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "catalogue.csv")
+	jsonFile := filepath.Join(dir, "catalogue.json")
+	if err := os.WriteFile(csvFile, []byte("station,country,region\nAbha,Saudi Arabia,Asia\nAden,Yemen,Asia\nAmsterdam,Netherlands,Europe\nAthens,Greece,\n"), 0o644); err != nil {
+		t.Fatalf("failed to write catalogue: %v", err)
+	}
+	if err := os.WriteFile(jsonFile, []byte(`[
+		{"station": "Abha", "country": "Saudi Arabia", "region": "Asia"},
+		{"station": "Aden", "country": "Yemen", "region": "Asia"},
+		{"station": "Amsterdam", "country": "Netherlands", "region": "Europe"},
+		{"station": "Athens", "country": "Greece"}
+	]`), 0o644); err != nil {
+		t.Fatalf("failed to write catalogue: %v", err)
+	}
+
+	agg, err := Aggregate("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	before := toResult(agg)
+
+	var results []string
+	for _, file := range []string{csvFile, jsonFile} {
+		catalogue, err := LoadCatalogue(file)
+		if err != nil {
+			t.Fatalf("cannot load %s: %v", file, err)
+		}
+		if !reflect.DeepEqual(catalogue.Levels, []string{"country", "region"}) {
+			t.Fatalf("unexpected levels %v", catalogue.Levels)
+		}
+
+		rollups, unknown := catalogue.Rollup(agg, 10)
+		if len(unknown) != len(agg)-4 || slices.Contains(unknown, "Abha") {
+			t.Errorf("got %d unknown stations, expected %d", len(unknown), len(agg)-4)
+		}
+		for _, r := range rollups {
+			total := int64(0)
+			for _, g := range r.Groups {
+				total += g.count
+			}
+			if total != 1000 {
+				t.Errorf("groups of %s have %d rows, expected 1000", r.Level, total)
+			}
+		}
+
+		asia := rollups[1].Groups["Asia"]
+		abha, aden := agg["Abha"], agg["Aden"]
+		if asia.Min != min(abha.Min, aden.Min) || asia.Max != max(abha.Max, aden.Max) || asia.count != abha.count+aden.count {
+			t.Errorf("Asia is %+v, expected Abha %+v merged with Aden %+v", asia, abha, aden)
+		}
+		if rollups[1].Groups["unknown"].count != 1000-asia.count-rollups[1].Groups["Europe"].count {
+			t.Errorf("stations without a region should be unknown")
+		}
+		results = append(results, fmt.Sprint(toResult(rollups[0].Groups), toResult(rollups[1].Groups)))
+	}
+	if results[0] != results[1] {
+		t.Errorf("CSV and JSON catalogues disagree\n%s\n%s", results[0], results[1])
+	}
+	if !reflect.DeepEqual(before, toResult(agg)) {
+		t.Error("rollup changed the station aggregations")
+	}
+}
+
+func TestAggregateFilter(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+
+	minValue, maxValue := -5.0, 30.05
+	filter := &Filter{
+		Include:  []string{"Abha", "Aden", "Accra", "Medan", "Lomé", "Milwaukee", "Nowhere"},
+		Exclude:  []string{"Aden"},
+		Pattern:  regexp.MustCompile(`^[A-M]`),
+		MinValue: &minValue,
+		MaxValue: &maxValue,
+	}
+
+	// The same predicates over the strict parser
+	var kept bytes.Buffer
+	var expectedCounts FilterCounts
+	for _, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+		name, v, _ := reference.ParseLine(line)
+		switch {
+		case !slices.Contains(filter.Include, name) || slices.Contains(filter.Exclude, name):
+			expectedCounts.Name++
+		case !filter.Pattern.MatchString(name):
+			expectedCounts.Pattern++
+		case v < minValue || v > maxValue:
+			expectedCounts.Value++
+		default:
+			kept.WriteString(line + "\n")
+		}
+	}
+	expected, err := reference.Aggregate(&kept)
+	if err != nil {
+		t.Fatalf("reference aggregate failed: %v", err)
+	}
+
+	for _, sch := range []schema.Schema{schema.Default, {Separator: ';', Scale: 2, Signs: schema.SignMinus}} {
+		agg, err := AggregateContext(context.Background(), "../measurements_small.txt", Options{Schema: sch, Filter: filter, NumWorkers: 3, ChunkSize: 1024})
+		if err != nil {
+			t.Fatalf("aggregate failed: %v", err)
+		}
+		actual := map[string]string{}
+		for name, a := range agg {
+			actual[name] = reference.Line(a.Min, a.Mean, a.Max, a.count)
+		}
+		if diff := reference.Diff(reference.FormatCount(expected), actual); diff != "" {
+			t.Errorf("scale %d: result mismatch\n%s", sch.Scale, diff)
+		}
+		if filter.Filtered != expectedCounts {
+			t.Errorf("scale %d: got %v, expected %v", sch.Scale, filter.Filtered, expectedCounts)
+		}
+	}
+}
+
+func TestPlanQuery(t *testing.T) {
+	catalogue, err := newCatalogue([]map[string]string{
+		{"station": "Hanoi", "country": "VN", "region": "Asia"},
+		{"station": "Ho Chi Minh City", "country": "VN", "region": "Asia"},
+		{"station": "Abha", "country": "SA", "region": "Asia"},
+	})
+	if err != nil {
+		t.Fatalf("cannot build catalogue: %v", err)
+	}
+
+	q, err := query.Parse("SELECT name WHERE name IN ('Hanoi', 'Abha', 'Aden') AND country = 'VN' AND NOT name = 'Aden' AND value > 40 AND value <= 50 AND mean > 20")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	filter, residual, err := planQuery(q, catalogue, schema.Default, nil)
+	if err != nil {
+		t.Fatalf("plan failed: %v", err)
+	}
+	if !reflect.DeepEqual(filter.Include, []string{"Hanoi"}) || !reflect.DeepEqual(filter.Exclude, []string{"Aden"}) {
+		t.Errorf("got include %v and exclude %v, expected [Hanoi] and [Aden]", filter.Include, filter.Exclude)
+	}
+	if filter.MinValue == nil || math.Abs(*filter.MinValue-40.1) > 1e-9 || filter.MaxValue == nil || *filter.MaxValue != 50 {
+		t.Errorf("got value bounds %v and %v, expected 40.1 and 50", filter.MinValue, filter.MaxValue)
+	}
+	if want := "(((name IN ('Hanoi', 'Abha', 'Aden') AND country = 'VN') AND NOT name = 'Aden') AND mean > 20)"; residual.String() != want {
+		t.Errorf("got residual %s, expected %s", residual, want)
+	}
+
+	// Nothing to push down
+	q, _ = query.Parse("SELECT name WHERE country = 'unknown' OR max > 40")
+	if filter, _, err := planQuery(q, catalogue, schema.Default, nil); err != nil || filter != nil {
+		t.Errorf("got filter %+v and error %v, expected neither", filter, err)
+	}
+
+	for _, in := range []string{"SELECT name WHERE value > 40 OR max > 40", "SELECT name WHERE value = 'x'", "SELECT name WHERE value IN (1, 2)"} {
+		q, _ = query.Parse(in)
+		if _, _, err := planQuery(q, catalogue, schema.Default, nil); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
+
+func TestRunQuery(t *testing.T) {
+	agg, err := Aggregate("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	var expected []string
+	for name, a := range agg {
+		if a.Max > 40 {
+			expected = append(expected, name)
+		}
+	}
+	slices.SortFunc(expected, func(a, b string) int { return -cmp.Compare(agg[a].Mean, agg[b].Mean) })
+	expected = expected[:5]
+
+	q, err := query.Parse("SELECT name, mean WHERE max > 40 ORDER BY mean DESC LIMIT 5")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	res, err := RunQuery(context.Background(), "../measurements_small.txt", q, nil, Options{})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(res.Rows) != len(expected) {
+		t.Fatalf("got %d rows, expected %d", len(res.Rows), len(expected))
+	}
+	for i, row := range res.Rows {
+		if row[1].Num != agg[expected[i]].Mean {
+			t.Errorf("row %d is %v, expected %s with mean %v", i, row, expected[i], agg[expected[i]].Mean)
+		}
+	}
+
+	// Bounding the value aggregates fewer rows
+	q, _ = query.Parse("SELECT name, max, count WHERE name = 'Abha' AND value < 20")
+	if res, err = RunQuery(context.Background(), "../measurements_small.txt", q, nil, Options{}); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(res.Rows) != 1 || res.Rows[0][1].Num >= 20 || res.Rows[0][2].Num >= float64(agg["Abha"].count) {
+		t.Errorf("unexpected result %+v for Abha %+v", res.Rows, agg["Abha"])
+	}
+
+	// Nearest-rank percentiles of the values of each station
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+	values := map[string][]float64{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+		name, val, _ := strings.Cut(line, ";")
+		v, _ := strconv.ParseFloat(val, 64)
+		values[name] = append(values[name], v)
+	}
+	q, _ = query.Parse("SELECT name, p95, p0 WHERE p95 > 30 AND value > -60 ORDER BY p95 DESC")
+	if res, err = RunQuery(context.Background(), "../measurements_small.txt", q, nil, Options{NumWorkers: 3, ChunkSize: 512}); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(res.Rows) == 0 {
+		t.Fatal("no station with a p95 above 30")
+	}
+	for _, row := range res.Rows {
+		v := slices.DeleteFunc(slices.Clone(values[row[0].Str]), func(v float64) bool { return v <= -60 })
+		slices.Sort(v)
+		p95 := v[int(math.Ceil(0.95*float64(len(v))))-1]
+		if row[1].Num != p95 || row[2].Num != v[0] || p95 <= 30 {
+			t.Errorf("row %v, expected p95 %v and p0 %v", row, p95, v[0])
+		}
+	}
+
+	q, _ = query.Parse("SELECT name, p101")
+	if _, err := RunQuery(context.Background(), "../measurements_small.txt", q, nil, Options{}); err == nil || !strings.Contains(err.Error(), "p101") {
+		t.Errorf("expected an unknown column error, got %v", err)
+	}
+}
+
+func TestRunQueryCanonical(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(input, []byte("Saigon;25.0\nHo Chi Minh City;27.0\nsaigon;29.0\nAbha;-1.0\n"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	opts := Options{Canonical: &Canonical{Fold: true, Aliases: map[string]string{"saigon": "Ho Chi Minh City"}}}
+
+	// The scan sees the names of the file, a name pushed down would drop the rows of Saigon
+	q, _ := query.Parse("SELECT name, count, p50 WHERE name = 'Ho Chi Minh City' AND value < 28")
+	if filter, _, err := planQuery(q, nil, schema.Default, opts.Canonical); err != nil || filter.Include != nil {
+		t.Errorf("got filter %+v and error %v, expected no names", filter, err)
+	}
+	res, err := RunQuery(context.Background(), input, q, nil, opts)
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(res.Rows) != 1 || res.Rows[0][1].Num != 2 || res.Rows[0][2].Num != 25 {
+		t.Errorf("got %v, expected Ho Chi Minh City with 2 rows and a median of 25", res.Rows)
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+
+	// The same statistics the naive way, with offsets and line numbers
+	type row struct {
+		name         string
+		value        float64
+		offset, line int64
+	}
+	var rows []row
+	values := map[string][]float64{}
+	offset := int64(0)
+	for i, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+		name, v, _ := reference.ParseLine(line)
+		rows = append(rows, row{name, v, offset, int64(i + 1)})
+		values[name] = append(values[name], v)
+		offset += int64(len(line)) + 1
+	}
+	const k = 1.3
+	var expected []string
+	for _, r := range rows {
+		vs := values[r.name]
+		mean, variance := 0.0, 0.0
+		for _, v := range vs {
+			mean += v / float64(len(vs))
+		}
+		for _, v := range vs {
+			variance += (v - mean) * (v - mean) / float64(len(vs))
+		}
+		if math.Abs(r.value-mean) > k*math.Sqrt(variance)+1e-9 {
+			expected = append(expected, fmt.Sprintf("%d:%d:%s=%.1f", r.line, r.offset, r.name, r.value))
+		}
+	}
+
+	anomalies, stats, err := DetectAnomalies(context.Background(), "../measurements_small.txt", Options{NumWorkers: 3, ChunkSize: 500}, AnomalyOptions{K: k})
+	if err != nil {
+		t.Fatalf("detect failed: %v", err)
+	}
+	var actual []string
+	for _, a := range anomalies {
+		actual = append(actual, fmt.Sprintf("%d:%d:%s=%.1f", a.Line, a.Offset, a.Station, a.Value))
+		if math.Abs(a.Deviation) <= k {
+			t.Errorf("%+v deviates less than %v", a, k)
+		}
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %d anomalies %v\nexpected %d %v", len(actual), actual, len(expected), expected)
+	}
+	if len(stats) != len(values) || stats["Abha"].Count != 4 || math.Abs(stats["Abha"].Mean-17.175) > 1e-9 {
+		t.Errorf("unexpected statistics %+v for Abha", stats["Abha"])
+	}
+}
+
+func TestDetectAnomaliesPercentiles(t *testing.T) {
+	var b strings.Builder
+	for i := range 100 {
+		// 1 to 100 for A in a shuffled order, and a constant B in between
+		fmt.Fprintf(&b, "A;%d\nB;7\n", (i*37)%100+1)
+	}
+	file := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(file, []byte(b.String()), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	lower, upper := 5.0, 95.0
+	sch := schema.Schema{Separator: ';', Scale: 0, Signs: schema.SignMinus}
+	anomalies, stats, err := DetectAnomalies(context.Background(), file, Options{Schema: sch, ChunkSize: 64}, AnomalyOptions{Lower: &lower, Upper: &upper})
+	if err != nil {
+		t.Fatalf("detect failed: %v", err)
+	}
+	if stats["A"].Lower != 5 || stats["A"].Upper != 95 || stats["B"].Stddev != 0 {
+		t.Errorf("unexpected statistics %+v and %+v", stats["A"], stats["B"])
+	}
+	var flagged []float64
+	for _, a := range anomalies {
+		if a.Station != "A" || a.Offset != int64(strings.Index(b.String(), fmt.Sprintf("\nA;%v\n", a.Value))+1) {
+			t.Errorf("unexpected anomaly %+v", a)
+		}
+		flagged = append(flagged, a.Value)
+	}
+	slices.Sort(flagged)
+	if expected := []float64{1, 2, 3, 4, 96, 97, 98, 99, 100}; !reflect.DeepEqual(flagged, expected) {
+		t.Errorf("got %v, expected %v", flagged, expected)
+	}
+
+	for _, opts := range []AnomalyOptions{{}, {K: -1}, {Lower: &upper, Upper: &lower}} {
+		if _, _, err := DetectAnomalies(context.Background(), file, Options{Schema: sch}, opts); err == nil {
+			t.Errorf("%+v: expected an error", opts)
+		}
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	agg, err := Aggregate("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+
+	// The expected output has names with ", " such as "Washington, D.C."
+	baseline, err := LoadBaseline("../output_small.txt")
+	if err != nil {
+		t.Fatalf("cannot load baseline: %v", err)
+	}
+	if len(baseline) != len(agg) || baseline["Washington, D.C."] == nil {
+		t.Fatalf("got %d stations, expected %d with Washington, D.C.", len(baseline), len(agg))
+	}
+	report := CompareBaseline(agg, baseline, 1)
+	if len(report.Deltas) != len(agg) || report.Deltas[0] != (StationDelta{Name: report.Deltas[0].Name}) {
+		t.Errorf("a result compared with its own output changed: %+v", report.Deltas[0])
+	}
+
+	// A snapshot of serve, with a station gone and another one new
+	stats := toStats(agg)
+	stats[0].Mean += 2.5
+	stats[1].Min -= 0.3
+	stats[2].Name = "Atlantis"
+	data, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatalf("cannot encode snapshot: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	if baseline, err = LoadBaseline(file); err != nil {
+		t.Fatalf("cannot load baseline: %v", err)
+	}
+	report = CompareBaseline(agg, baseline, 1)
+	if report.Deltas[0] != (StationDelta{Name: stats[0].Name, Mean: -2.5}) {
+		t.Errorf("biggest change is %+v, expected %s by -2.5", report.Deltas[0], stats[0].Name)
+	}
+	if i := slices.IndexFunc(report.Deltas, func(d StationDelta) bool { return d.Name == stats[1].Name }); report.Deltas[i].Min != 0.3 {
+		t.Errorf("got %+v, expected min up by 0.3", report.Deltas[i])
+	}
+	if !reflect.DeepEqual(report.Gone, []string{"Atlantis"}) || !reflect.DeepEqual(report.New, []string{toStats(agg)[2].Name}) {
+		t.Errorf("got new %v and gone %v", report.New, report.Gone)
+	}
+
+}
+
+func TestCanonical(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "measurements.txt")
+	// Abéché composed and decomposed, with white space and another case, and Ho Chi Minh City under its old name
+	lines := "Abéché;10.0\nAbéché;20.0\n ABÉCHÉ ;30.0\nSaigon;25.0\nHo Chi Minh City;27.0\nsaigon;29.0\nAbha;-1.0\n"
+	if err := os.WriteFile(input, []byte(strings.Repeat(lines, 50)), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	aliasesFile := filepath.Join(dir, "aliases.csv")
+	if err := os.WriteFile(aliasesFile, []byte("# alias,name\nSaigon,Ho Chi Minh City\n"), 0o644); err != nil {
+		t.Fatalf("failed to write aliases: %v", err)
+	}
+	aliases, err := LoadAliases(aliasesFile)
+	if err != nil {
+		t.Fatalf("cannot load aliases: %v", err)
+	}
+
+	tests := []struct {
+		canonical *Canonical
+		want      map[string]int64 // count of each station
+	}{
+		{nil, map[string]int64{"Abéché": 50, "Abéché": 50, " ABÉCHÉ ": 50, "Saigon": 50, "Ho Chi Minh City": 50, "saigon": 50, "Abha": 50}},
+		{&Canonical{NFC: true}, map[string]int64{"Abéché": 100, " ABÉCHÉ ": 50, "Saigon": 50, "Ho Chi Minh City": 50, "saigon": 50, "Abha": 50}},
+		{&Canonical{Trim: true, NFC: true, Fold: true}, map[string]int64{"abéché": 150, "saigon": 100, "ho chi minh city": 50, "abha": 50}},
+		{&Canonical{Aliases: aliases}, map[string]int64{"Abéché": 50, "Abéché": 50, " ABÉCHÉ ": 50, "Ho Chi Minh City": 100, "saigon": 50, "Abha": 50}},
+		{&Canonical{Trim: true, NFC: true, Fold: true, Aliases: aliases}, map[string]int64{"abéché": 150, "Ho Chi Minh City": 150, "abha": 50}},
+	}
+	for i, tt := range tests {
+		for _, sch := range []schema.Schema{schema.Default, {Separator: ';', Scale: 2, Signs: schema.SignMinus}} {
+			agg, err := AggregateContext(context.Background(), input, Options{Schema: sch, Canonical: tt.canonical, NumWorkers: 3, ChunkSize: 256})
+			if err != nil {
+				t.Fatalf("aggregate failed: %v", err)
+			}
+			got := map[string]int64{}
+			for name, a := range agg {
+				got[name] = a.count
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("test %d, scale %d: got %v, expected %v", i, sch.Scale, got, tt.want)
+			}
+		}
+	}
+
+	agg, err := AggregateContext(context.Background(), input, Options{Canonical: &Canonical{Trim: true, NFC: true, Aliases: aliases}})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if a := agg["Abéché"]; a.Min != 10 || a.Max != 20 || a.Mean != 15 {
+		t.Errorf("Abéché is %+v, expected 10/15/20", a)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// The challenge data is within the limits
+	for _, sch := range []schema.Schema{schema.Default, {Separator: ';', Scale: 2, Signs: schema.SignMinus}} {
+		if _, err := AggregateContext(context.Background(), "../measurements_small.txt", Options{Schema: sch, Limits: &ChallengeLimits, ChunkSize: 512}); err != nil {
+			t.Errorf("scale %d: %v", sch.Scale, err)
+		}
+	}
+
+	const valid = "Abha;12.3\nAden;-99.9\nAccra;99.9\n"
+	tests := []struct {
+		name   string
+		line   string
+		reason string
+	}{
+		{"value too high", "Aden;9999.9", "value out of -99.9"},
+		{"value too low", "Aden;-100.0", "value out of -99.9"},
+		{"empty name", ";12.3", "empty station name"},
+		{"long name", strings.Repeat("x", 2<<20) + ";12.3", "station name of 2097152 bytes, longer than 100"},
+		{"invalid UTF-8", "Ab\xffha;12.3", "isn't valid UTF-8"},
+	}
+	for _, tt := range tests {
+		input := filepath.Join(t.TempDir(), "measurements.txt")
+		data := strings.Repeat(valid, 100) + tt.line + "\n" + strings.Repeat(valid, 100)
+		if err := os.WriteFile(input, []byte(data), 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+		offset := int64(len(valid) * 100)
+
+		for _, sch := range []schema.Schema{schema.Default, {Separator: ';', Scale: 2, Signs: schema.SignMinus}} {
+			_, err := AggregateContext(context.Background(), input, Options{Schema: sch, Limits: &ChallengeLimits, NumWorkers: 3, ChunkSize: 256})
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Errorf("%s, scale %d: got %v, expected a limit error", tt.name, sch.Scale, err)
+				continue
+			}
+			if limitErr.Offset != offset || !strings.Contains(limitErr.Reason, tt.reason) || !strings.HasPrefix(tt.line, string(limitErr.Line)) {
+				t.Errorf("%s, scale %d: got %v at offset %d, expected %q at offset %d", tt.name, sch.Scale, err, limitErr.Offset, tt.reason, offset)
+			}
+		}
+
+		// Wider limits let it through
+		if tt.name == "value too high" {
+			wide := Limits{MaxNameLength: 100, MinValue: -9999.9, MaxValue: 9999.9}
+			if _, err := AggregateContext(context.Background(), input, Options{Limits: &wide}); err != nil {
+				t.Errorf("%s with %+v: %v", tt.name, wide, err)
+			}
+		}
+	}
+
+	// Values the hot path would read digit by digit, whatever the bytes are, are errors with limits
+	for _, line := range []string{"Abha;x", "Oslo;5-5", "Abha;1.23", "Abha;+1.0", "Abha;"} {
+		input := filepath.Join(t.TempDir(), "measurements.txt")
+		if err := os.WriteFile(input, []byte(strings.Repeat(valid, 100)+line+"\n"), 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+		if _, err := AggregateContext(context.Background(), input, Options{Limits: &ChallengeLimits}); err == nil {
+			t.Errorf("%q: expected an invalid value error", line)
+		}
+	}
+
+	// Rows dropped by the filter aren't checked, the rows it keeps are
+	input := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(input, []byte(strings.Repeat(valid, 100)+"Bad;150.0\nAbha;150.0\n"), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	maxValue := 60.0
+	filters := []struct {
+		filter *Filter
+		fails  bool
+	}{
+		{&Filter{Exclude: []string{"Bad"}, MaxValue: &maxValue}, false},
+		{&Filter{Exclude: []string{"Bad", "Abha"}}, false},
+		{&Filter{Exclude: []string{"Bad"}}, true},
+		{&Filter{MaxValue: &maxValue}, false},
+	}
+	for i, tt := range filters {
+		for _, sch := range []schema.Schema{schema.Default, {Separator: ';', Scale: 2, Signs: schema.SignMinus}} {
+			_, err := AggregateContext(context.Background(), input, Options{Schema: sch, Filter: tt.filter, Limits: &ChallengeLimits, ChunkSize: 256})
+			var limitErr *LimitError
+			if errors.As(err, &limitErr) != tt.fails || (err != nil && limitErr == nil) {
+				t.Errorf("filter %d, scale %d: got %v, expected a limit error: %v", i, sch.Scale, err, tt.fails)
+			}
+		}
+	}
+}
+
+func TestHugeCounts(t *testing.T) {
+	// Two workers with 3 billion rows of 99.9 each, more than 32 bits hold on any platform
+	const rows = 3e9
+	agg := map[string]*Aggregation{}
+	for range 2 {
+		// Through the JSON of distributed workers too
+		data, err := json.Marshal(partialEntry{Name: "Abha", Min: 99.9, Max: 99.9, Sum: rows * 999, Count: rows})
+		if err != nil {
+			t.Fatalf("cannot encode entry: %v", err)
+		}
+		var e partialEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			t.Fatalf("cannot decode entry: %v", err)
+		}
+		mergeInto(agg, []byte(e.Name), &Aggregation{Min: e.Min, Max: e.Max, sum: e.Sum, count: e.Count})
+	}
+	a := agg["Abha"]
+	a.Mean = float64(a.sum) / float64(a.count) / 10
+	if a.count != 2*rows || toResult(agg)["Abha"] != "99.9/99.9/99.9" {
+		t.Errorf("got %d rows summing to %d, expected %v rows of 99.9", a.count, a.sum, 2*rows)
+	}
+
+	// The generic path checks its sums, values of 18 digits overflow after a few rows
+	var c, other metricColumn
+	c.grow()
+	other.grow()
+	if !c.add(0, math.MaxInt64/2) || !other.add(0, math.MaxInt64/2) {
+		t.Fatalf("sums overflowed too early")
+	}
+	if !c.merge(0, &other, 0) || c.count[0] != 2 {
+		t.Errorf("got %d rows summing to %d, expected 2 rows", c.count[0], c.sum[0])
+	}
+	if c.merge(0, &other, 0) {
+		t.Errorf("merged sums overflowed without an error")
+	}
+	if other.add(0, math.MaxInt64/2+2) {
+		t.Errorf("sums overflowed without an error")
+	}
+
+	input := filepath.Join(t.TempDir(), "measurements.txt")
+	if err := os.WriteFile(input, []byte(strings.Repeat("Abha;-999999999.999999999\n", 10)), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	sch := schema.Schema{Separator: ';', Scale: 9, Signs: schema.SignMinus}
+	for _, chunkSize := range []int64{0, 64} {
+		if _, err := AggregateContext(context.Background(), input, Options{Schema: sch, ChunkSize: chunkSize}); err == nil || !strings.Contains(err.Error(), "overflows") {
+			t.Errorf("chunk size %d: got %v, expected an overflow", chunkSize, err)
+		}
+	}
+}
+
+func TestLineFormats(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+	expected, err := Aggregate("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if l, err := SniffLines("../measurements_small.txt", EncodingUTF8); err != nil || !l.plain() {
+		t.Errorf("challenge input sniffed as %+v, %v, expected plain lines", l, err)
+	}
+
+	// The same measurements with a byte order mark and CRLF, then with a comma as separator and names quoted when
+	// they contain one, which some of them do
+	crlf := append(bytes.Clone(utf8BOM), bytes.ReplaceAll(input, []byte("\n"), []byte("\r\n"))...)
+	var quoted bytes.Buffer
+	quoted.Write(utf8BOM)
+	for _, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+		name, val, _ := strings.Cut(line, ";")
+		if strings.Contains(name, ",") {
+			name = `"` + name + `"`
+		}
+		fmt.Fprintf(&quoted, "%s,%s\r\n", name, val)
+	}
+	comma := schema.Schema{Separator: ',', Scale: 1, Signs: schema.SignMinus}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		sch   schema.Schema
+		lines LineFormat
+	}{
+		{"bom", append(bytes.Clone(utf8BOM), input...), schema.Default, LineFormat{}},
+		{"crlf", crlf, schema.Default, LineFormat{CRLF: true}},
+		{"quoted", quoted.Bytes(), comma, LineFormat{CRLF: true, Quotes: true}},
+	}
+	for _, tt := range tests {
+		inputFile := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(inputFile, tt.data, 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+		if l, err := SniffLines(inputFile, EncodingUTF8); err != nil || l != tt.lines {
+			t.Errorf("%s: sniffed %+v, %v, expected %+v", tt.name, l, err, tt.lines)
+		}
+
+		for _, opts := range []Options{{Schema: tt.sch}, {Schema: tt.sch, Lines: &tt.lines, NumWorkers: 3, ChunkSize: 512}} {
+			agg, err := AggregateContext(context.Background(), inputFile, opts)
+			if err != nil {
+				t.Fatalf("%s: aggregate failed: %v", tt.name, err)
+			}
+			if len(agg) != len(expected) {
+				t.Errorf("%s: got %d stations, expected %d", tt.name, len(agg), len(expected))
+			}
+			for name, e := range expected {
+				if a := agg[name]; a == nil || a.Min != e.Min || a.Max != e.Max || a.sum != e.sum || a.count != e.count {
+					t.Errorf("%s: station %q: got %+v, expected %+v", tt.name, name, a, e)
+				}
+			}
+		}
+	}
+
+	// Anomalies of the CRLF file are the ones of the plain one, at offsets shifted by the byte order mark and the
+	// carriage returns of the lines before
+	crlfFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(crlfFile, crlf, 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	want, _, err := DetectAnomalies(context.Background(), "../measurements_small.txt", Options{}, AnomalyOptions{K: 1})
+	if err != nil {
+		t.Fatalf("cannot detect anomalies: %v", err)
+	}
+	got, _, err := DetectAnomalies(context.Background(), crlfFile, Options{ChunkSize: 512}, AnomalyOptions{K: 1})
+	if err != nil {
+		t.Fatalf("cannot detect anomalies: %v", err)
+	}
+	for i := range want {
+		want[i].Offset += int64(len(utf8BOM)) + want[i].Line - 1
+	}
+	if len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d anomalies %v, expected %d %v", len(got), got, len(want), want)
+	}
+}
+
+func TestLateCRLF(t *testing.T) {
+	// LF lines past what SniffLines reads, then a CRLF one which used to be read as 12.3 with a digit '\r' - '0'
+	data := bytes.Repeat([]byte("Abha;1.0\n"), sniffSize/9+1)
+	data = append(data, "Abha;12.3\r\n"...)
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, data, 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	scale2 := schema.Schema{Separator: ';', Scale: 2, Signs: schema.SignMinus}
+	for _, sch := range []schema.Schema{schema.Default, scale2} {
+		if _, err := AggregateContext(context.Background(), inputFile, Options{Schema: sch}); err == nil || !strings.Contains(err.Error(), "CRLF") {
+			t.Errorf("scale %d: expected a CRLF error, got %v", sch.Scale, err)
+		}
+		agg, err := AggregateContext(context.Background(), inputFile, Options{Schema: sch, Lines: &LineFormat{CRLF: true}})
+		if err != nil {
+			t.Fatalf("scale %d: aggregate failed: %v", sch.Scale, err)
+		}
+		if a := agg["Abha"]; a == nil || a.Max != 12.3 {
+			t.Errorf("scale %d: got %+v, expected a max of 12.3", sch.Scale, a)
+		}
+	}
+}
+
+func TestQuotedNames(t *testing.T) {
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	data := "\"Fort \"\"Apache\"\";AZ\";10.0\n\"Fort \"\"Apache\"\";AZ\";20.0\nAbha;1.0\n\"Abha\";3.0\n"
+	if err := os.WriteFile(inputFile, []byte(data), 0o644); err != nil {
+		t.Fatalf("failed to write input: %v", err)
+	}
+	agg, err := AggregateContext(context.Background(), inputFile, Options{})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	got := map[string]string{}
+	for name, a := range agg {
+		got[name] = fmt.Sprintf("%.1f/%.1f/%.1f", a.Min, a.Mean, a.Max)
+	}
+	want := map[string]string{`Fort "Apache";AZ`: "10.0/15.0/20.0", "Abha": "1.0/2.0/3.0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+
+	for _, bad := range []string{"Abha;1.0\n\"Abha;1.0\n", "Abha;1.0\n\"Abha\"x;1.0\n"} {
+		if err := os.WriteFile(inputFile, []byte(bad), 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+		if _, err := AggregateContext(context.Background(), inputFile, Options{}); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+	// The measurements Latin-1 can write, a few names aren't
+	var latin1 bytes.Buffer
+	for _, line := range strings.SplitAfter(string(input), "\n") {
+		if _, err := charmap.ISO8859_1.NewEncoder().String(line); err == nil {
+			latin1.WriteString(line)
+		}
+	}
+
+	tests := []struct {
+		enc     Encoding
+		extra   string // UTF-8 lines only this encoding can write
+		encoder *encoding.Encoder
+		crlf    bool
+	}{
+		{EncodingLatin1, "", charmap.ISO8859_1.NewEncoder(), false},
+		{EncodingWindows1252, "Zoë’s Hill;5.0\n", charmap.Windows1252.NewEncoder(), false},
+		// U+0A0A is written "\n\n" in UTF-16LE, at odd offsets after the code unit of "Ċ" (0x010A)
+		{EncodingUTF16LE, "Ċਊ;7.0\n中山;-3.5\n𝄞 Hill;1.0\n", unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder(), true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		text := strings.Repeat(latin1.String()+tt.extra, 3)
+		plainFile := filepath.Join(dir, "utf8.txt")
+		if err := os.WriteFile(plainFile, []byte(text), 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+		if tt.crlf {
+			text = strings.ReplaceAll(text, "\n", "\r\n")
+		}
+		encoded, err := tt.encoder.Bytes([]byte(text))
+		if err != nil {
+			t.Fatalf("encoding %d: cannot encode input: %v", tt.enc, err)
+		}
+		inputFile := filepath.Join(dir, "input.txt")
+		if err := os.WriteFile(inputFile, encoded, 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+
+		expected, err := Aggregate(plainFile)
+		if err != nil {
+			t.Fatalf("aggregate failed: %v", err)
+		}
+		var last Progress
+		opts := Options{Encoding: tt.enc, NumWorkers: 3, ChunkSize: 256, Progress: func(p Progress) { last = p }}
+		agg, err := AggregateContext(context.Background(), inputFile, opts)
+		if err != nil {
+			t.Fatalf("encoding %d: aggregate failed: %v", tt.enc, err)
+		}
+		if len(agg) != len(expected) {
+			t.Errorf("encoding %d: got %d stations, expected %d", tt.enc, len(agg), len(expected))
+		}
+		for name, e := range expected {
+			if a := agg[name]; a == nil || a.Min != e.Min || a.Max != e.Max || a.sum != e.sum || a.count != e.count {
+				t.Errorf("encoding %d: station %q: got %+v, expected %+v", tt.enc, name, a, e)
+			}
+		}
+		// Progress counts bytes of the file, not of the UTF-8 text
+		if !last.Done || last.Bytes != int64(len(encoded)) {
+			t.Errorf("encoding %d: last progress %+v, expected %d bytes", tt.enc, last, len(encoded))
+		}
+	}
+}
+
+func TestSplitsFileUTF16(t *testing.T) {
+	text := strings.Repeat("Ċਊ;7.0\r\nAbha;1.0\r\n𝄞;-2.5\r\n", 200)
+	encoded, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatalf("cannot encode input: %v", err)
+	}
+	inputFile := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(inputFile, append(encoded, 'x'), 0o644); err != nil { // and half a code unit
+		t.Fatalf("failed to write input: %v", err)
+	}
+
+	for _, numParts := range []int{1, 7, 100, 5000} {
+		parts, err := splitsFile(inputFile, numParts, 2)
+		if err != nil {
+			t.Fatalf("cannot split file: %v", err)
+		}
+		offset := int64(0)
+		for _, p := range parts {
+			if p.offset != offset {
+				t.Fatalf("%d parts: part at offset %d, expected %d", numParts, p.offset, offset)
+			}
+			if p.offset != 0 && !bytes.Equal(encoded[p.offset-4:p.offset], []byte("\r\x00\n\x00")) {
+				t.Errorf("%d parts: part at offset %d doesn't start a line", numParts, p.offset)
+			}
+			offset += p.length
+		}
+		if offset != int64(len(encoded))+1 {
+			t.Errorf("%d parts: parts end at %d, expected %d", numParts, offset, len(encoded)+1)
+		}
+	}
+}
+
+func TestSplitsFileMoreThanSize(t *testing.T) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read input: %v", err)
+	}
+
+	// Way more parts than the file has lines, and than size / 32
+	parts, err := splitsFile("../measurements_small.txt", 5000, 1)
+	if err != nil {
+		t.Fatalf("splitsFile failed: %v", err)
+	}
+
+	offset := int64(0)
+	for _, part := range parts {
+		if part.offset != offset || part.length <= 0 {
+			t.Fatalf("part %+v does not continue at offset %d", part, offset)
+		}
+		offset += part.length
+		if input[offset-1] != '\n' {
+			t.Fatalf("part %+v does not end on a newline", part)
+		}
+	}
+	if offset != int64(len(input)) {
+		t.Errorf("parts cover %d bytes, expected %d", offset, len(input))
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	bench.Benchmark(b, "../measurements_small.txt", func(filename string) error {
+		_, err := Aggregate(filename)
+		return err
+	})
+}
+
+func FuzzAggregate(f *testing.F) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		f.Fatalf("failed to read input: %v", err)
+	}
+	f.Add(input)
+	for _, seed := range []string{"", "Abha;12.3\n", "Abha;12.3", "Abha\n", "\n", ";\n", "Ab;ha;1.0\n", "Abha;1.23\nAbha;-0.0\n"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, err := aggregate(context.Background(), bytes.NewReader(data), nil)
+		if !isChallengeInput(data) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("aggregate failed: %v", err)
+		}
+		checkAgainstReference(t, data, entries)
+	})
+}
+
+// isChallengeInput reports whether every line of data follows the rules of the challenge.
+func isChallengeInput(data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+	if data[len(data)-1] != '\n' {
+		return false
+	}
+	for _, line := range strings.Split(string(data[:len(data)-1]), "\n") {
+		if !reference.IsChallengeLine(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAgainstReference compares entries with what the strict parser of solution 1 gives for data.
+func checkAgainstReference(t *testing.T, data []byte, entries []*Entry) {
+	t.Helper()
+
+	expected, err := reference.Aggregate(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("reference aggregate failed: %v", err)
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("got %d stations, expected %d", len(entries), len(expected))
+	}
+	for _, e := range entries {
+		s, ok := expected[string(e.name)]
+		if !ok {
+			t.Fatalf("unexpected station %q", e.name)
+		}
+		if e.value.Min != s.Min || e.value.Max != s.Max || e.value.sum != s.SumX10 || e.value.count != s.Count {
+			t.Errorf("station %q: got %+v, expected %+v", e.name, *e.value, *s)
+		}
+	}
+}
+
+func FuzzSplitsFile(f *testing.F) {
+	input, err := os.ReadFile("../measurements_small.txt")
+	if err != nil {
+		f.Fatalf("failed to read input: %v", err)
+	}
+	f.Add(input, uint16(8))
+	f.Add(input, uint16(5000))
+	f.Add([]byte(""), uint16(4))
+	f.Add([]byte("no newline at all"), uint16(3))
+	f.Add([]byte("a;1.0\n\n\nb;2.0"), uint16(100))
+
+	f.Fuzz(func(t *testing.T, data []byte, numParts uint16) {
+		if numParts == 0 {
+			return
+		}
+		inputFile := filepath.Join(t.TempDir(), "input.txt")
+		if err := os.WriteFile(inputFile, data, 0o644); err != nil {
+			t.Fatalf("failed to write input: %v", err)
+		}
+
+		parts, err := splitsFile(inputFile, int(numParts), 1)
+		if err != nil {
+			t.Fatalf("splitsFile failed: %v", err)
+		}
+		if len(parts) > int(numParts) {
+			t.Fatalf("got %d parts, asked for %d", len(parts), numParts)
+		}
+
+		// The parts must tile the file, and every part but the last must end on a newline
+		offset := int64(0)
+		for i, part := range parts {
+			if part.offset != offset || part.length <= 0 {
+				t.Fatalf("part %d %+v does not continue at offset %d", i, part, offset)
+			}
+			offset += part.length
+			if i < len(parts)-1 && data[offset-1] != '\n' {
+				t.Fatalf("part %d %+v does not end on a newline", i, part)
+			}
+		}
+		if offset != int64(len(data)) {
+			t.Errorf("parts cover %d bytes, expected %d", offset, len(data))
+		}
+	})
+}
+
+// TestDifferential runs the solution with 1 to 64 workers and random chunk sizes over random datasets and compares it with the strict parser of solution 1.
+func TestDifferential(t *testing.T) {
+	bench.Differential(t, 64, func(i int, rnd *rand.Rand, filename string) (map[string]string, error) {
+		// Small chunks so that there's work for every worker and many boundaries
+		opts := Options{NumWorkers: i + 1, ChunkSize: 64 + rnd.Int63n(4096)}
+		agg, err := AggregateContext(context.Background(), filename, opts)
+		if err != nil {
+			return nil, err
+		}
+		actual := map[string]string{}
+		for k, v := range agg {
+			actual[k] = reference.Line(v.Min, v.Mean, v.Max, v.count)
+		}
+		return actual, nil
+	})
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/minhtri06/1brc/schema"
+)
+
+// MetricTable is the result of a file with several value columns ("Station;temp;humidity;pressure"), or grouped
+// in time windows. It's column oriented: Metrics[m].Min[i] is the minimum of metric m over row i of the table,
+// which is station Stations[i] during the window starting at Windows[i].
+type MetricTable struct {
+	// Sorted by station, then chronologically
+	Stations []string
+	Windows  []time.Time // zero without Options.Window
+	Metrics  []Metric
+}
+
+type Metric struct {
+	Name string
+
+	// One element per row of the table, in the order of MetricTable.Stations.
+	// Stations that never had a value for the metric have a Count of 0 and NaN statistics.
+	Min   []float64
+	Mean  []float64
+	Max   []float64
+	Count []int64
+}
+
+// metricColumn holds the scaled statistics of one value column, element i belongs to station i.
+// Values have up to 18 digits, so unlike the hot path sums are checked for overflows.
+type metricColumn struct {
+	min   []int64
+	max   []int64
+	sum   []int64
+	count []int64
+
+	// With percentiles set, histogram[i] is the number of rows of each value of station i
+	percentiles bool
+	histogram   []map[int64]int64
+}
+
+func (c *metricColumn) grow() {
+	c.min = append(c.min, math.MaxInt64)
+	c.max = append(c.max, math.MinInt64)
+	c.sum = append(c.sum, 0)
+	c.count = append(c.count, 0)
+	if c.percentiles {
+		c.histogram = append(c.histogram, make(map[int64]int64))
+	}
+}
+
+// reset drops every station, keeping the memory.
+func (c *metricColumn) reset() {
+	c.min, c.max, c.sum, c.count = c.min[:0], c.max[:0], c.sum[:0], c.count[:0]
+	c.histogram = c.histogram[:0]
+}
+
+// add returns false if the sum of the station overflows.
+func (c *metricColumn) add(station int, v int64) bool {
+	sum, ok := addInt64(c.sum[station], v)
+	c.min[station] = min(c.min[station], v)
+	c.max[station] = max(c.max[station], v)
+	c.sum[station] = sum
+	c.count[station]++
+	if c.percentiles {
+		c.histogram[station][v]++
+	}
+	return ok
+}
+
+// merge merges station src of other into station dst of c, it returns false if the sum overflows.
+func (c *metricColumn) merge(dst int, other *metricColumn, src int) bool {
+	sum, ok := addInt64(c.sum[dst], other.sum[src])
+	c.min[dst] = min(c.min[dst], other.min[src])
+	c.max[dst] = max(c.max[dst], other.max[src])
+	c.sum[dst] = sum
+	c.count[dst] += other.count[src]
+	if c.percentiles {
+		for v, n := range other.histogram[src] {
+			c.histogram[dst][v] += n
+		}
+	}
+	return ok
+}
+
+// percentile is the scaled nearest-rank percentile p of station i, which must have a value.
+func (c *metricColumn) percentile(i int, p float64) int64 {
+	m := moments{count: c.count[i], histogram: c.histogram[i]}
+	return m.percentile(p)
+}
+
+// addInt64 adds without wrapping around, ok is false if the sum doesn't fit in 64 bits.
+func addInt64(a, b int64) (sum int64, ok bool) {
+	sum = a + b
+	return sum, (sum > a) == (b > 0)
+}
+
+// toAggregations returns the statistics of the stations with at least one value, rows must not have windows.
+func (c *metricColumn) toAggregations(keys []groupKey, divisor float64) map[string]*Aggregation {
+	agg := make(map[string]*Aggregation, len(keys))
+	for i, key := range keys {
+		if c.count[i] == 0 {
+			continue
+		}
+		agg[key.name] = &Aggregation{
+			Min:   float64(c.min[i]) / divisor,
+			Mean:  float64(c.sum[i]) / float64(c.count[i]) / divisor,
+			Max:   float64(c.max[i]) / divisor,
+			count: c.count[i],
+			sum:   c.sum[i],
+		}
+	}
+	return agg
+}
+
+// AggregateMetrics aggregates every value column of opts.Schema, see AggregateContext.
+func AggregateMetrics(ctx context.Context, filename string, opts Options) (*MetricTable, error) {
+	sch, err := opts.schema()
+	if err != nil {
+		return nil, err
+	}
+
+	table := &MetricTable{}
+	if sch.IsDefault() {
+		// The hot path only knows a single column
+		agg, err := AggregateContext(ctx, filename, opts)
+		if err != nil {
+			return nil, err
+		}
+		table.Stations = make([]string, 0, len(agg))
+		for name := range agg {
+			table.Stations = append(table.Stations, name)
+		}
+		slices.Sort(table.Stations)
+		table.Windows = make([]time.Time, len(table.Stations))
+
+		m := Metric{Name: sch.ColumnName(0)}
+		for _, name := range table.Stations {
+			a := agg[name]
+			m.Min = append(m.Min, a.Min)
+			m.Mean = append(m.Mean, a.Mean)
+			m.Max = append(m.Max, a.Max)
+			m.Count = append(m.Count, a.count)
+		}
+		table.Metrics = []Metric{m}
+		return table, nil
+	}
+
+	keys, columns, err := aggregateColumns(ctx, filename, opts, sch)
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Or(cmp.Compare(keys[a].name, keys[b].name), cmp.Compare(keys[a].window, keys[b].window))
+	})
+	for _, i := range order {
+		table.Stations = append(table.Stations, keys[i].name)
+		var start time.Time
+		if opts.Window != WindowNone {
+			start = time.Unix(keys[i].window, 0).UTC()
+		}
+		table.Windows = append(table.Windows, start)
+	}
+
+	divisor := sch.Divisor()
+	for c := range columns {
+		col := &columns[c]
+		m := Metric{
+			Name:  sch.ColumnName(c),
+			Min:   make([]float64, len(order)),
+			Mean:  make([]float64, len(order)),
+			Max:   make([]float64, len(order)),
+			Count: make([]int64, len(order)),
+		}
+		for j, i := range order {
+			m.Count[j] = col.count[i]
+			if col.count[i] == 0 {
+				m.Min[j], m.Mean[j], m.Max[j] = math.NaN(), math.NaN(), math.NaN()
+				continue
+			}
+			m.Min[j] = float64(col.min[i]) / divisor
+			m.Mean[j] = float64(col.sum[i]) / float64(col.count[i]) / divisor
+			m.Max[j] = float64(col.max[i]) / divisor
+		}
+		table.Metrics = append(table.Metrics, m)
+	}
+	return table, nil
+}
+
+// groupKey identifies a row of the generic path: a station during a window, window is 0 without Options.Window.
+type groupKey struct {
+	name   string
+	window int64
+}
+
+// aggregateColumns runs the generic path over filename and merges the columns of every worker,
+// the same window of a station in several workers ends up in one row. Row i of the columns is keys[i].
+func aggregateColumns(ctx context.Context, filename string, opts Options, sch schema.Schema) ([]groupKey, []metricColumn, error) {
+	var keys []groupKey
+	index := make(map[groupKey]int, 10000)
+	columns := make([]metricColumn, sch.NumColumns())
+	for c := range columns {
+		columns[c].percentiles = opts.percentiles
+	}
+
+	var overflow error
+	err := runWorkers(ctx, filename, opts, sch, func(a *chunkAggregator) {
+		for _, e := range a.entries() {
+			key := groupKey{string(e.key()), e.window}
+			i, ok := index[key]
+			if !ok {
+				i = len(keys)
+				keys = append(keys, key)
+				index[key] = i
+				for c := range columns {
+					columns[c].grow()
+				}
+			}
+			for c := range columns {
+				if !columns[c].merge(i, &a.columns[c], e.index) && overflow == nil {
+					overflow = fmt.Errorf("sum of column %s of station %q overflows 64 bits", sch.ColumnName(c), key.name)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if overflow != nil {
+		return nil, nil, overflow
+	}
+	return keys, columns, nil
+}
+
+// processColumns aggregates the complete lines of chunk written in any schema other than schema.Default,
+// values are checked by the schema instead of trusted.
+func (a *chunkAggregator) processColumns(chunk []byte) (int64, error) {
+	sep := a.schema.Separator
+	rows := int64(0)
+
+	for i := 0; i < len(chunk); {
+		// Find the station name and calculate the hash on the way
+		hash := uint64(fnvOffset)
+		start := i
+		var name []byte
+		if a.lines.Quotes && chunk[i] == '"' {
+			var err error
+			if name, i, err = a.quotedName(chunk, i); err != nil {
+				return 0, err
+			}
+			hash = fnvHash(name)
+		} else {
+			for ; chunk[i] != sep; i++ {
+				if chunk[i] == '\n' {
+					return 0, fmt.Errorf("missing separator in line %q", chunk[start:i])
+				}
+				hash ^= uint64(chunk[i])
+				hash *= uint64(fnvPrime)
+			}
+			name = chunk[start:i]
+		}
+		i++ // Skip the separator
+		rows++
+		if a.filter != nil && !a.keepName(hash, name) {
+			i += bytes.IndexByte(chunk[i:], '\n') + 1 // Skip the rest of the line
+			continue
+		}
+
+		window := int64(0)
+		if a.schema.Time != schema.TimeNone {
+			end := i
+			for chunk[end] != sep && chunk[end] != '\n' {
+				end++
+			}
+			if chunk[end] == '\n' {
+				return 0, fmt.Errorf("missing values after the timestamp in line %q", chunk[start:end])
+			}
+			sec, err := a.schema.ParseTime(chunk[i:end])
+			if err != nil {
+				return 0, err
+			}
+			i = end + 1 // Skip the separator
+
+			if a.window != WindowNone {
+				// The window is part of the key, mix it into the hash
+				window = a.window.start(sec)
+				for w := uint64(window); w != 0; w >>= 8 {
+					hash ^= w & 0xff
+					hash *= uint64(fnvPrime)
+				}
+			}
+		}
+		station, inserted := a.station(hash, name, window)
+		if inserted && a.limits != nil {
+			if reason := a.limits.checkName(name); reason != "" {
+				return 0, a.limitError(chunk, start, reason)
+			}
+		}
+
+		for c := range a.columns {
+			end := i
+			for chunk[end] != sep && chunk[end] != '\n' {
+				end++
+			}
+			last := c == len(a.columns)-1
+			if last != (chunk[end] == '\n') {
+				line := chunk[start : start+bytes.IndexByte(chunk[start:], '\n')]
+				return 0, fmt.Errorf("line %q doesn't have %d value columns", line, len(a.columns))
+			}
+			field := chunk[i:end]
+			if last && bytes.HasSuffix(field, []byte{'\r'}) {
+				if !a.lines.CRLF {
+					return 0, crlfError(chunk[start:end])
+				}
+				field = field[:len(field)-1]
+			}
+			// A metric that wasn't measured may be left empty, a single value can't
+			if len(field) > 0 || len(a.columns) == 1 {
+				v, err := a.schema.ParseValue(field)
+				if err != nil {
+					return 0, fmt.Errorf("column %s: %w", a.schema.ColumnName(c), err)
+				}
+				if a.filter == nil || a.keepValue(v) {
+					if a.limits != nil {
+						if reason := a.limits.checkValue(v, a.schema); reason != "" {
+							if len(a.columns) > 1 {
+								reason = fmt.Sprintf("in column %s %s", a.schema.ColumnName(c), reason)
+							}
+							return 0, a.limitError(chunk, start, reason)
+						}
+					}
+					if !a.columns[c].add(station, v) {
+						return 0, fmt.Errorf("sum of column %s of station %q overflows 64 bits", a.schema.ColumnName(c), name)
+					}
+				}
+			}
+			i = end + 1 // Skip the separator or the newline character
+		}
+	}
+	return rows, nil
+}
+
+// station returns the row of the station during window in the columns, adding it if it's new.
+// Unlike the hot path the map grows, as there can be way more windows than stations.
+func (a *chunkAggregator) station(hash uint64, name []byte, window int64) (index int, inserted bool) {
+	mask := uint64(len(a.m) - 1)
+	for bucket := hash & mask; ; bucket = (bucket + 1) & mask {
+		e := a.m[bucket]
+		if e == nil {
+			e = &Entry{name: bytes.Clone(name), index: len(a.columns[0].count), hash: hash, window: window}
+			if a.canonical != nil {
+				e.canonical = a.canonical.name(name)
+			}
+			a.m[bucket] = e
+			a.size++
+			if a.size >= len(a.m)/2 {
+				a.growMap()
+			}
+			for c := range a.columns {
+				a.columns[c].grow()
+			}
+			return e.index, true
+		}
+		if e.window == window && bytes.Equal(e.name, name) {
+			return e.index, false
+		}
+	}
+}
+
+// growMap doubles the custom map and puts every entry back in it.
+func (a *chunkAggregator) growMap() {
+	m := make([]*Entry, 2*len(a.m))
+	mask := uint64(len(m) - 1)
+	for _, e := range a.m {
+		if e == nil {
+			continue
+		}
+		bucket := e.hash & mask
+		for m[bucket] != nil {
+			bucket = (bucket + 1) & mask
+		}
+		m[bucket] = e
+	}
+	a.m = m
+}
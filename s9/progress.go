@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minhtri06/1brc/bench"
+)
+
+// partCounter counts what a worker has consumed from its FilePart.
+// Workers only touch it once per buffer, the reporter sums all of them every interval.
+type partCounter struct {
+	bytes atomic.Int64
+	rows  atomic.Int64
+	// transcoded is set when the worker reads the part through a decoder, which counts the bytes of the file itself
+	transcoded bool
+	_          [47]byte // pad to a cache line so workers don't fight over it
+}
+
+func (c *partCounter) add(bytes, rows int64) {
+	if !c.transcoded {
+		c.bytes.Add(bytes)
+	}
+	c.rows.Add(rows)
+}
+
+type Progress struct {
+	TotalBytes int64
+	Bytes      int64
+	Rows       int64
+	PartBytes  []int64 // bytes consumed per FilePart
+
+	Elapsed     time.Duration
+	BytesPerSec float64
+	RowsPerSec  float64
+	ETA         time.Duration
+	Done        bool
+}
+
+// reportProgress calls fn every interval with the sum of counters until the returned stop function is called,
+// which reports one last time with Done set.
+func reportProgress(parts []FilePart, counters []partCounter, interval time.Duration, fn func(Progress)) (stop func()) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	total := int64(0)
+	for _, part := range parts {
+		total += part.length
+	}
+	start := time.Now()
+
+	snapshot := func(done bool) Progress {
+		p := Progress{TotalBytes: total, PartBytes: make([]int64, len(counters)), Elapsed: time.Since(start), Done: done}
+		for i := range counters {
+			p.PartBytes[i] = counters[i].bytes.Load()
+			p.Bytes += p.PartBytes[i]
+			p.Rows += counters[i].rows.Load()
+		}
+		if secs := p.Elapsed.Seconds(); secs > 0 {
+			p.BytesPerSec = float64(p.Bytes) / secs
+			p.RowsPerSec = float64(p.Rows) / secs
+		}
+		if p.BytesPerSec > 0 {
+			p.ETA = time.Duration(float64(p.TotalBytes-p.Bytes) / p.BytesPerSec * float64(time.Second))
+		}
+		return p
+	}
+
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				fn(snapshot(false))
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		wg.Wait()
+		fn(snapshot(true))
+	}
+}
+
+// progressPrinter renders progress as a bar redrawn in place on a terminal, or as one log line per report otherwise.
+func progressPrinter(w io.Writer, tty bool) func(Progress) {
+	return func(p Progress) {
+		percent := 100.0
+		if p.TotalBytes > 0 {
+			percent = float64(p.Bytes) / float64(p.TotalBytes) * 100
+		}
+		stats := fmt.Sprintf("%5.1f%% %s/%s %s/s %s rows/s ETA %s",
+			percent, formatBytes(float64(p.Bytes)), formatBytes(float64(p.TotalBytes)),
+			formatBytes(p.BytesPerSec), bench.FormatCount(p.RowsPerSec), p.ETA.Round(time.Second))
+
+		if !tty {
+			fmt.Fprintf(w, "progress: %s\n", stats)
+			return
+		}
+
+		const width = 30
+		filled := int(percent / 100 * width)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+		fmt.Fprintf(w, "\r[%s] %s", bar, stats)
+		if p.Done {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for ; n >= 1024 && i < len(units)-1; i++ {
+		n /= 1024
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/minhtri06/1brc/query"
+	"github.com/minhtri06/1brc/schema"
+)
+
+// valueColumn is the value of a single row in a query, it can only be pushed down into the scan.
+const valueColumn = "value"
+
+// RunQuery aggregates filename and runs q over the stations, see package query. Rows have the columns name, min,
+// mean, max and count, the percentiles p0 to p100 the query uses, plus the levels of catalogue when it's not nil.
+// Percentiles need a histogram of every station, which is only kept when they're used. WHERE can also bound the
+// value of the rows being aggregated ("value > -60"), which is only allowed in top-level AND terms.
+func RunQuery(ctx context.Context, filename string, q *query.Query, catalogue *Catalogue, opts Options) (*query.Result, error) {
+	sch, err := opts.schema()
+	if err != nil {
+		return nil, err
+	}
+	filter, residual, err := planQuery(q, catalogue, sch, opts.Canonical)
+	if err != nil {
+		return nil, err
+	}
+	opts.Filter = filter
+
+	columns := []string{"name", "min", "mean", "max", "count"}
+	percentiles := map[string]float64{}
+	for _, c := range q.Columns() {
+		if p, ok := percentileColumn(c); ok {
+			percentiles[c] = p
+			columns = append(columns, c)
+		}
+	}
+	if catalogue != nil {
+		columns = append(columns, catalogue.Levels...)
+	}
+
+	var agg map[string]*Aggregation
+	stationPercentiles := map[string]map[string]float64{}
+	if len(percentiles) == 0 {
+		if agg, err = AggregateContext(ctx, filename, opts); err != nil {
+			return nil, err
+		}
+	} else {
+		if sch.NumColumns() > 1 || opts.Window != WindowNone {
+			return nil, errors.New("percentiles need a single value column and no window")
+		}
+		opts.percentiles = true
+		keys, metrics, err := aggregateColumns(ctx, filename, opts, sch)
+		if err != nil {
+			return nil, err
+		}
+		col := &metrics[0]
+		agg = col.toAggregations(keys, sch.Divisor())
+		for i, key := range keys {
+			if col.count[i] == 0 {
+				continue
+			}
+			values := make(map[string]float64, len(percentiles))
+			for c, p := range percentiles {
+				values[c] = float64(col.percentile(i, p)) / sch.Divisor()
+			}
+			stationPercentiles[key.name] = values
+		}
+	}
+	rows := make([]query.Row, 0, len(agg))
+	for name, a := range agg {
+		r := query.Row{
+			"name":  query.String(name),
+			"min":   query.Number(a.Min),
+			"mean":  query.Number(a.Mean),
+			"max":   query.Number(a.Max),
+			"count": query.Number(float64(a.count)),
+		}
+		for c, v := range stationPercentiles[name] {
+			r[c] = query.Number(v)
+		}
+		if catalogue != nil {
+			for i, group := range catalogue.groups(name) {
+				r[catalogue.Levels[i]] = query.String(group)
+			}
+		}
+		rows = append(rows, r)
+	}
+
+	residualQuery := *q
+	residualQuery.Where = residual
+	return residualQuery.Run(columns, rows)
+}
+
+// planQuery pushes the top-level AND terms of the WHERE clause the scan can check into a Filter: station names, catalogue
+// groups and the value of the rows. It returns the expression left to evaluate over the results, which still checks
+// names and groups as that costs nothing. With canonical set names and groups aren't pushed down, as the filter sees
+// the names written in the file and the query the canonical ones.
+func planQuery(q *query.Query, catalogue *Catalogue, sch schema.Schema, canonical *Canonical) (*Filter, query.Expr, error) {
+	filter := &Filter{}
+	var residual []query.Expr
+	include := func(names []string) {
+		if filter.Include == nil {
+			filter.Include = names
+			return
+		}
+		filter.Include = slices.DeleteFunc(filter.Include, func(n string) bool { return !slices.Contains(names, n) })
+	}
+
+	for _, term := range query.Conjuncts(q.Where) {
+		if c, ok := term.(*query.Compare); ok && c.Column == valueColumn {
+			if err := pushValueBound(filter, c, sch); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if usesColumn(term, valueColumn) {
+			return nil, nil, fmt.Errorf("%s can only be compared with a number in a top-level AND term: %s", valueColumn, term)
+		}
+		residual = append(residual, term)
+		if canonical != nil {
+			continue
+		}
+
+		switch t := term.(type) {
+		case *query.Compare:
+			if names, ok := stringValues(t); ok {
+				switch {
+				case t.Column == "name" && (t.Op == "=" || t.Op == "IN"):
+					include(names)
+				case t.Column == "name" && t.Op == "!=":
+					filter.Exclude = append(filter.Exclude, names...)
+				case t.Column == "name" && t.Op == "LIKE" && filter.Pattern == nil:
+					filter.Pattern = query.Like(names[0])
+				case catalogue != nil && (t.Op == "=" || t.Op == "IN") && !slices.Contains(names, unknownGroup):
+					if level := slices.Index(catalogue.Levels, t.Column); level >= 0 {
+						include(catalogue.stationsIn(level, names))
+					}
+				}
+			}
+		case *query.Not:
+			if c, ok := t.Expr.(*query.Compare); ok && c.Column == "name" && (c.Op == "=" || c.Op == "IN") {
+				if names, ok := stringValues(c); ok {
+					filter.Exclude = append(filter.Exclude, names...)
+				}
+			}
+		}
+	}
+
+	if filter.Include == nil && filter.Exclude == nil && filter.Pattern == nil && filter.MinValue == nil && filter.MaxValue == nil {
+		filter = nil
+	}
+	return filter, query.Conjoin(residual), nil
+}
+
+// pushValueBound narrows the value bounds of filter to a comparison of the value column. Bounds are inclusive,
+// strict ones move to the next value the schema can represent.
+func pushValueBound(filter *Filter, c *query.Compare, sch schema.Schema) error {
+	if len(c.Values) != 1 || !c.Values[0].IsNum {
+		return fmt.Errorf("%s can only be compared with a number: %s", valueColumn, c)
+	}
+	v, step := c.Values[0].Num, 1/sch.Divisor()
+	setMin := func(m float64) {
+		if filter.MinValue == nil || m > *filter.MinValue {
+			filter.MinValue = &m
+		}
+	}
+	setMax := func(m float64) {
+		if filter.MaxValue == nil || m < *filter.MaxValue {
+			filter.MaxValue = &m
+		}
+	}
+
+	switch c.Op {
+	case "=":
+		setMin(v)
+		setMax(v)
+	case ">=":
+		setMin(v)
+	case ">":
+		setMin((math.Floor(v*sch.Divisor()+1e-9) + 1) * step)
+	case "<=":
+		setMax(v)
+	case "<":
+		setMax((math.Ceil(v*sch.Divisor()-1e-9) - 1) * step)
+	default:
+		return fmt.Errorf("%s can't be pushed into the scan: %s", valueColumn, c)
+	}
+	return nil
+}
+
+// percentileColumn returns the percentile of a column named p0 to p100.
+func percentileColumn(c string) (float64, bool) {
+	if !strings.HasPrefix(c, "p") || len(c) < 2 || (len(c) > 2 && c[1] == '0') {
+		return 0, false
+	}
+	p, err := strconv.Atoi(c[1:])
+	if err != nil || p < 0 || p > 100 || c[1] == '+' || c[1] == '-' {
+		return 0, false
+	}
+	return float64(p), true
+}
+
+// stringValues returns the literals of a comparison if they're all strings.
+func stringValues(c *query.Compare) ([]string, bool) {
+	names := make([]string, len(c.Values))
+	for i, v := range c.Values {
+		if v.IsNum {
+			return nil, false
+		}
+		names[i] = v.Str
+	}
+	return names, true
+}
+
+func usesColumn(e query.Expr, column string) bool {
+	return slices.Contains((&query.Query{Where: e}).Columns(), column)
+}
+
+// errNoQuery is returned by the query command without a query.
+var errNoQuery = errors.New(`missing query, such as "SELECT name, mean WHERE max > 40 ORDER BY mean DESC LIMIT 10"`)
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Levels of the hierarchy above stations, from the finest to the coarsest.
+var catalogueLevels = []string{"city", "country", "region"}
+
+// unknownGroup collects the stations missing from the catalogue, or without a value for a level.
+const unknownGroup = "unknown"
+
+// Catalogue maps station names to the groups they belong to at each level of the hierarchy.
+type Catalogue struct {
+	// Levels the catalogue has, in the order of catalogueLevels.
+	Levels   []string
+	stations map[string][]string // groups of a station, one per level
+}
+
+// LoadCatalogue reads a catalogue from a JSON file (by extension) or a CSV file.
+//
+// The CSV has a header with a "station" column and any of "city", "country" and "region":
+//
+//	station,country,region
+//	Abha,Saudi Arabia,Asia
+//
+// The JSON is an array of objects with the same keys:
+//
+//	[{"station": "Abha", "country": "Saudi Arabia", "region": "Asia"}]
+func LoadCatalogue(filename string) (*Catalogue, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open catalogue: %w", err)
+	}
+	defer f.Close()
+
+	var records []map[string]string
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		if err := json.NewDecoder(f).Decode(&records); err != nil {
+			return nil, fmt.Errorf("invalid catalogue %s: %w", filename, err)
+		}
+	} else if records, err = readCatalogueCSV(f); err != nil {
+		return nil, fmt.Errorf("invalid catalogue %s: %w", filename, err)
+	}
+	return newCatalogue(records)
+}
+
+func readCatalogueCSV(r io.Reader) ([]map[string]string, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+
+	var records []map[string]string
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := make(map[string]string, len(row))
+		for i, v := range row {
+			record[header[i]] = strings.TrimSpace(v)
+		}
+		records = append(records, record)
+	}
+}
+
+func newCatalogue(records []map[string]string) (*Catalogue, error) {
+	c := &Catalogue{stations: make(map[string][]string, len(records))}
+	for _, level := range catalogueLevels {
+		for _, record := range records {
+			if _, ok := record[level]; ok {
+				c.Levels = append(c.Levels, level)
+				break
+			}
+		}
+	}
+	if len(c.Levels) == 0 {
+		return nil, fmt.Errorf("catalogue has none of the levels %s", strings.Join(catalogueLevels, ", "))
+	}
+
+	for i, record := range records {
+		station := record["station"]
+		if station == "" {
+			return nil, fmt.Errorf("record %d of the catalogue has no station", i+1)
+		}
+		if _, ok := c.stations[station]; ok {
+			return nil, fmt.Errorf("station %q is twice in the catalogue", station)
+		}
+		groups := make([]string, len(c.Levels))
+		for j, level := range c.Levels {
+			groups[j] = cmp.Or(record[level], unknownGroup)
+		}
+		c.stations[station] = groups
+	}
+	return c, nil
+}
+
+// groups returns the group of the station at every level, unknown ones for stations missing from the catalogue.
+func (c *Catalogue) groups(station string) []string {
+	if groups, ok := c.stations[station]; ok {
+		return groups
+	}
+	groups := make([]string, len(c.Levels))
+	for i := range groups {
+		groups[i] = unknownGroup
+	}
+	return groups
+}
+
+// stationsIn returns the stations of the catalogue in any of groups at a level, never nil.
+func (c *Catalogue) stationsIn(level int, groups []string) []string {
+	stations := []string{}
+	for name, g := range c.stations {
+		if slices.Contains(groups, g[level]) {
+			stations = append(stations, name)
+		}
+	}
+	return stations
+}
+
+// Rollup is the aggregation of every group of a level.
+type Rollup struct {
+	Level  string
+	Groups map[string]*Aggregation
+}
+
+// Rollup merges the aggregation of every station into the groups it belongs to, level by level, without touching agg.
+// Stations missing from the catalogue go to the "unknown" group of every level, and are returned sorted.
+func (c *Catalogue) Rollup(agg map[string]*Aggregation, divisor float64) (rollups []Rollup, unknown []string) {
+	rollups = make([]Rollup, len(c.Levels))
+	for i, level := range c.Levels {
+		rollups[i] = Rollup{Level: level, Groups: make(map[string]*Aggregation)}
+	}
+
+	for name, a := range agg {
+		groups, ok := c.stations[name]
+		if !ok {
+			unknown = append(unknown, name)
+		}
+		for i := range rollups {
+			group := unknownGroup
+			if ok {
+				group = groups[i]
+			}
+			g := rollups[i].Groups[group]
+			if g == nil {
+				g = &Aggregation{Min: a.Min, Max: a.Max}
+				rollups[i].Groups[group] = g
+			}
+			g.Min = min(g.Min, a.Min)
+			g.Max = max(g.Max, a.Max)
+			g.sum += a.sum
+			g.count += a.count
+		}
+	}
+
+	for _, r := range rollups {
+		for _, g := range r.Groups {
+			g.Mean = float64(g.sum) / float64(g.count) / divisor
+		}
+	}
+	slices.Sort(unknown)
+	return rollups, unknown
+}
+
+// errUnknownStations is returned by the run command with -strict when stations are missing from the catalogue.
+var errUnknownStations = errors.New("stations missing from the catalogue")
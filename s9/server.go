@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/minhtri06/1brc/schema"
+	"github.com/minhtri06/1brc/writeresult"
+)
+
+// Ingestion service: devices POST measurement lines (same format as the file, up to maxBody bytes, chunked is fine),
+// each body is parsed by the generic path, which checks every value, into a pooled custom map and then merged into
+// the shared store. A body is merged all or nothing, so a malformed or oversized request never leaves half of its
+// rows behind.
+
+// defaultMaxBody is the largest request body the service reads unless told otherwise.
+const defaultMaxBody = 256 * 1024 * 1024 // 256 MB
+
+type stationStats struct {
+	Name  string  `json:"name"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	Max   float64 `json:"max"`
+	Count int64   `json:"count"`
+}
+
+// stationStore is the concurrent station map shared by all requests.
+type stationStore struct {
+	mu  sync.RWMutex
+	agg map[string]*Aggregation
+}
+
+func newStationStore() *stationStore {
+	return &stationStore{agg: make(map[string]*Aggregation, 10000)}
+}
+
+func (s *stationStore) merge(entries []*Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		mergeInto(s.agg, e.name, e.value)
+	}
+}
+
+// snapshot returns a copy of the current state with Mean computed.
+func (s *stationStore) snapshot() map[string]*Aggregation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyAggregation(s.agg)
+}
+
+// reset clears the store and returns what it held.
+func (s *stationStore) reset() map[string]*Aggregation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.agg
+	s.agg = make(map[string]*Aggregation, 10000)
+	return copyAggregation(old)
+}
+
+func copyAggregation(agg map[string]*Aggregation) map[string]*Aggregation {
+	res := make(map[string]*Aggregation, len(agg))
+	for name, a := range agg {
+		c := *a
+		c.Mean = float64(c.sum) / float64(c.count) / 10
+		res[name] = &c
+	}
+	return res
+}
+
+func toStats(agg map[string]*Aggregation) []stationStats {
+	stats := make([]stationStats, 0, len(agg))
+	for name, a := range agg {
+		stats = append(stats, stationStats{Name: name, Min: a.Min, Mean: a.Mean, Max: a.Max, Count: a.count})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+type server struct {
+	store *stationStore
+	// maxBody is the largest request body in bytes, larger ones are rejected with 413
+	maxBody int64
+	// aggregators holds the *chunkAggregator of past requests, so each body doesn't allocate a map and a read buffer
+	aggregators sync.Pool
+}
+
+func newServer(maxBody int64) *server {
+	s := &server{store: newStationStore(), maxBody: maxBody}
+	s.aggregators.New = func() any {
+		// Device input isn't trusted, the generic path checks the values the hot path would take as they come
+		a := newChunkAggregator(schema.Default, WindowNone, LineFormat{})
+		a.columns = make([]metricColumn, 1)
+		return a
+	}
+	return s
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /measurements", s.handleIngest)
+	mux.HandleFunc("GET /stations", s.handleStations)
+	mux.HandleFunc("GET /stations/{name}", s.handleStation)
+	mux.HandleFunc("GET /result", s.handleResult)
+	mux.HandleFunc("POST /snapshot", s.handleSnapshot)
+	mux.HandleFunc("POST /reset", s.handleReset)
+	return mux
+}
+
+func (s *server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.aggregateBody(r.Context(), http.MaxBytesReader(w, r.Body, s.maxBody))
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s.store.merge(entries)
+
+	var rows int64
+	for _, e := range entries {
+		rows += e.value.count
+	}
+	writeJSON(w, map[string]int64{"rows": rows})
+}
+
+func (s *server) handleStations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, toStats(s.store.snapshot()))
+}
+
+func (s *server) handleStation(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	a, ok := s.store.snapshot()[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("station %q not found", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, stationStats{Name: name, Min: a.Min, Mean: a.Mean, Max: a.Max, Count: a.count})
+}
+
+func (s *server) handleResult(w http.ResponseWriter, r *http.Request) {
+	agg := s.store.snapshot()
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeresult.ToWriter(w, toResult(agg))
+	case "json":
+		writeJSON(w, toStats(agg))
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
+
+func (s *server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, toStats(s.store.snapshot()))
+}
+
+// handleReset clears the state and responds with the snapshot taken right before clearing.
+func (s *server) handleReset(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, toStats(s.store.reset()))
+}
+
+// aggregateBody parses a request body with a pooled aggregator, it stops when the client goes away.
+// Malformed values are errors, and the map of the generic path grows instead of panicking on many stations.
+func (s *server) aggregateBody(ctx context.Context, body io.Reader) ([]*Entry, error) {
+	a := s.aggregators.Get().(*chunkAggregator)
+	defer func() {
+		a.reset()
+		s.aggregators.Put(a)
+	}()
+	if err := a.add(ctx, body, nil); err != nil {
+		return nil, fmt.Errorf("malformed measurements: %w", err)
+	}
+
+	// The store keeps the entries, they must not point into the aggregator
+	col := &a.columns[0]
+	entries := make([]*Entry, 0, a.size)
+	for _, e := range a.entries() {
+		i := e.index
+		entries = append(entries, &Entry{name: e.name, value: &Aggregation{
+			Min:   float64(col.min[i]) / 10,
+			Max:   float64(col.max[i]) / 10,
+			sum:   col.sum[i],
+			count: col.count[i],
+		}})
+	}
+	return entries, nil
+}
+
+// serve runs the ingestion service on addr until ctx is canceled, then shuts down gracefully.
+func (s *server) serve(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s.handler()}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("cannot shut down server: %w", err)
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
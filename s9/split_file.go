@@ -12,7 +12,9 @@ type FilePart struct {
 	length int64
 }
 
-func splitsFile(filename string, numParts int) ([]FilePart, error) {
+// splitsFile cuts filename into about numParts parts of whole lines. unit is the size in bytes of the code units of
+// the encoding, 2 for UTF-16LE whose newline is "\n\x00" at an even offset, parts are only cut between them.
+func splitsFile(filename string, numParts int, unit int) ([]FilePart, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open file: %w", err)
@@ -41,7 +43,10 @@ func splitsFile(filename string, numParts int) ([]FilePart, error) {
 			break
 		}
 
-		end := offset + partSize - bufSize
+		// Never seek before the current offset, it happens when the file is smaller than numParts * bufSize,
+		// nor past the end of the file, it happens when the previous part ran to the end looking for a newline.
+		end := min(size, max(offset, offset+partSize-bufSize))
+		end -= end % int64(unit)
 		if _, err := file.Seek(end, io.SeekStart); err != nil {
 			return nil, fmt.Errorf("failed to seek file: %w", err)
 		}
@@ -55,17 +60,45 @@ func splitsFile(filename string, numParts int) ([]FilePart, error) {
 			if n == 0 {
 				break
 			}
-			newlineIdx := bytes.IndexByte(buf[:n], '\n')
+			newlineIdx := indexNewline(buf[:n], unit)
 			if newlineIdx != -1 {
-				end += int64(newlineIdx) + 1
+				end += int64(newlineIdx + unit)
 				break
 			}
-			end += int64(n)
+			if n < unit {
+				// The file ends with half a code unit
+				end += int64(n)
+				break
+			}
+			end += int64(n - n%unit)
+			if n%unit != 0 {
+				// Read the split code unit again with the next buffer
+				if _, err := file.Seek(end, io.SeekStart); err != nil {
+					return nil, fmt.Errorf("failed to seek file: %w", err)
+				}
+			}
 		}
 
+		if end == offset {
+			// Nothing left to split
+			break
+		}
 		parts = append(parts, FilePart{offset, end - offset})
 		offset = end
 	}
 
 	return parts, nil
 }
+
+// indexNewline returns the index of the first newline code unit in buf, which starts at a code unit, or -1.
+func indexNewline(buf []byte, unit int) int {
+	if unit == 1 {
+		return bytes.IndexByte(buf, '\n')
+	}
+	for i := 0; i+1 < len(buf); i += 2 {
+		if buf[i] == '\n' && buf[i+1] == 0 {
+			return i
+		}
+	}
+	return -1
+}
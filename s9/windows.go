@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Window is the size of the tumbling windows rows are grouped in, by the timestamp column of the schema.
+// Windows are aligned on UTC.
+type Window uint8
+
+const (
+	WindowNone Window = iota // one group per station, whatever the timestamps
+	WindowHour
+	WindowDay
+	WindowMonth
+)
+
+func parseWindow(s string) (Window, error) {
+	switch s {
+	case "":
+		return WindowNone, nil
+	case "hour":
+		return WindowHour, nil
+	case "day":
+		return WindowDay, nil
+	case "month":
+		return WindowMonth, nil
+	}
+	return 0, fmt.Errorf("unknown window %q, expected hour, day or month", s)
+}
+
+// start returns the start of the window sec falls in, in seconds since the epoch.
+func (w Window) start(sec int64) int64 {
+	switch w {
+	case WindowHour:
+		return floorTo(sec, 3600)
+	case WindowDay:
+		return floorTo(sec, 24*3600)
+	case WindowMonth:
+		t := time.Unix(sec, 0).UTC()
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	return 0
+}
+
+// label formats the start of a window just precisely enough, labels of a size sort chronologically.
+func (w Window) label(start time.Time) string {
+	switch w {
+	case WindowHour:
+		return start.UTC().Format("2006-01-02T15")
+	case WindowDay:
+		return start.UTC().Format("2006-01-02")
+	case WindowMonth:
+		return start.UTC().Format("2006-01")
+	}
+	return ""
+}
+
+// floorTo rounds sec down to a multiple of n, before the epoch too.
+func floorTo(sec, n int64) int64 {
+	r := sec % n
+	if r < 0 {
+		r += n
+	}
+	return sec - r
+}
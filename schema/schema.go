@@ -0,0 +1,243 @@
+// Package schema describes how a measurements file is laid out: the byte between the station name
+// and the value, and how values are written. The challenge format is Default, the fast solutions
+// keep their integer-only hot path for it and fall back to a generic one for any other schema.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Sign is a set of the sign forms a value may start with.
+type Sign uint8
+
+const (
+	SignMinus Sign = 1 << iota // -1.5
+	SignPlus                   // +1.5
+)
+
+// TimeFormat is the format of the timestamp column that follows the station name, if any.
+type TimeFormat uint8
+
+const (
+	TimeNone    TimeFormat = iota
+	TimeRFC3339            // 2026-10-19T12:00:00Z
+	TimeUnix               // 1792411200, seconds since the epoch
+)
+
+const (
+	MaxScale  = 9
+	maxDigits = 18 // scaled values with up to 18 digits fit in an int64
+)
+
+type Schema struct {
+	// Separator sits between the station name and the value, names can't contain it.
+	Separator byte
+	// Scale is the number of fractional digits, values are kept as integers multiplied by 10^Scale.
+	// A value may have fewer fractional digits ("1.5" is 150 with a Scale of 2) but not more.
+	Scale int
+	// Signs the values may start with.
+	Signs Sign
+	// Columns names the value columns of "Station;temp;humidity;pressure" rows, which are separated by
+	// Separator too. Nil means a single value column. With several columns, values that weren't measured may be empty.
+	Columns []string
+	// Time is the format of the timestamp column between the station name and the values, TimeNone if there's none.
+	Time TimeFormat
+}
+
+// Default is the format of the challenge: "Hamburg;-12.3".
+var Default = Schema{Separator: ';', Scale: 1, Signs: SignMinus}
+
+var pow10 = [MaxScale + 1]int64{1, 10, 100, 1000, 10000, 100000, 1000000, 10000000, 100000000, 1000000000}
+
+// IsZero reports whether s is the zero value, which callers usually replace by Default.
+func (s Schema) IsZero() bool {
+	return s.Separator == 0 && s.Scale == 0 && s.Signs == 0 && s.Columns == nil && s.Time == TimeNone
+}
+
+// IsDefault reports whether s reads the same files as Default, whatever its single column is named.
+func (s Schema) IsDefault() bool {
+	return s.Separator == Default.Separator && s.Scale == Default.Scale && s.Signs == Default.Signs &&
+		len(s.Columns) <= 1 && s.Time == TimeNone
+}
+
+// NumColumns is the number of value columns of a row.
+func (s Schema) NumColumns() int {
+	return max(1, len(s.Columns))
+}
+
+// ColumnName is the name of value column i, "value" for the single column of a schema without names.
+func (s Schema) ColumnName(i int) string {
+	if i < len(s.Columns) {
+		return s.Columns[i]
+	}
+	return "value"
+}
+
+// Validate reports whether the schema can be parsed unambiguously.
+func (s Schema) Validate() error {
+	switch {
+	case s.Separator == '\n' || s.Separator == '\r':
+		return fmt.Errorf("invalid separator %q", s.Separator)
+	case s.Separator >= '0' && s.Separator <= '9', s.Separator == '.', s.Separator == '-', s.Separator == '+':
+		return fmt.Errorf("separator %q can't be part of a value", s.Separator)
+	case s.Separator == '"':
+		return errors.New("separator '\"' quotes station names")
+	case s.Separator >= utf8.RuneSelf:
+		return fmt.Errorf("separator %#x isn't an ASCII byte, it could be part of a UTF-8 name", s.Separator)
+	case s.Scale < 0 || s.Scale > MaxScale:
+		return fmt.Errorf("scale %d out of range 0..%d", s.Scale, MaxScale)
+	case s.Time > TimeUnix:
+		return fmt.Errorf("unknown time format %d", s.Time)
+	case s.Time == TimeRFC3339 && (s.Separator == ':' || s.Separator == 'T' || s.Separator == 'Z'):
+		return fmt.Errorf("separator %q is part of RFC 3339 timestamps", s.Separator)
+	}
+	for i, name := range s.Columns {
+		if name == "" {
+			return fmt.Errorf("column %d has no name", i)
+		}
+		if slices.Contains(s.Columns[:i], name) {
+			return fmt.Errorf("duplicate column %q", name)
+		}
+	}
+	return nil
+}
+
+// Divisor turns a scaled value back into the real one.
+func (s Schema) Divisor() float64 {
+	return float64(pow10[s.Scale])
+}
+
+// Decimals is the number of fractional digits results are written with, at least one so means stay readable.
+func (s Schema) Decimals() int {
+	return max(1, s.Scale)
+}
+
+// ParseValue parses b into an integer multiplied by 10^Scale.
+func (s Schema) ParseValue(b []byte) (int64, error) {
+	i := 0
+	negative := false
+	if len(b) > 0 {
+		switch {
+		case b[0] == '-' && s.Signs&SignMinus != 0:
+			negative = true
+			i++
+		case b[0] == '+' && s.Signs&SignPlus != 0:
+			i++
+		}
+	}
+
+	v := int64(0)
+	digits, fraction := 0, -1 // fraction counts the digits after the point, -1 before it
+	for ; i < len(b); i++ {
+		c := b[i]
+		if c == '.' && fraction < 0 && s.Scale > 0 {
+			fraction = 0
+			continue
+		}
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid value %q", b)
+		}
+		if digits++; digits > maxDigits {
+			return 0, fmt.Errorf("value %q has too many digits", b)
+		}
+		if fraction >= 0 {
+			if fraction++; fraction > s.Scale {
+				return 0, fmt.Errorf("value %q has more than %d fractional digits", b, s.Scale)
+			}
+		}
+		v = v*10 + int64(c-'0')
+	}
+	if digits == 0 || fraction == 0 {
+		return 0, fmt.Errorf("invalid value %q", b)
+	}
+
+	padding := s.Scale - max(0, fraction)
+	if digits+padding > maxDigits {
+		return 0, fmt.Errorf("value %q has too many digits", b)
+	}
+	v *= pow10[padding]
+	if negative {
+		v = -v
+	}
+	return v, nil
+}
+
+// ParseTime parses a timestamp in the time format of the schema into seconds since the epoch.
+func (s Schema) ParseTime(b []byte) (int64, error) {
+	switch s.Time {
+	case TimeRFC3339:
+		t, err := time.Parse(time.RFC3339, string(b))
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", b)
+		}
+		return t.Unix(), nil
+	case TimeUnix:
+		sec, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", b)
+		}
+		return sec, nil
+	}
+	return 0, errors.New("schema has no timestamp column")
+}
+
+// ParseTimeFormat reads a time format from a flag: "", "rfc3339" or "unix".
+func ParseTimeFormat(s string) (TimeFormat, error) {
+	switch s {
+	case "":
+		return TimeNone, nil
+	case "rfc3339":
+		return TimeRFC3339, nil
+	case "unix":
+		return TimeUnix, nil
+	}
+	return 0, fmt.Errorf("unknown time format %q, expected rfc3339 or unix", s)
+}
+
+// ParseSeparator reads a separator from a flag, accepting the names of the usual invisible ones.
+func ParseSeparator(s string) (byte, error) {
+	switch s {
+	case "tab", `\t`:
+		return '\t', nil
+	case "space":
+		return ' ', nil
+	}
+	if len(s) != 1 {
+		return 0, errors.New("separator must be a single byte")
+	}
+	return s[0], nil
+}
+
+// ParseColumns reads the names of the value columns from a comma separated flag, "" means a single unnamed column.
+func ParseColumns(s string) []string {
+	if s == "" {
+		return nil
+	}
+	columns := strings.Split(s, ",")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	return columns
+}
+
+// ParseSigns reads a set of signs from a flag such as "-", "+" or "-+".
+func ParseSigns(s string) (Sign, error) {
+	var signs Sign
+	for _, c := range s {
+		switch c {
+		case '-':
+			signs |= SignMinus
+		case '+':
+			signs |= SignPlus
+		default:
+			return 0, fmt.Errorf("invalid sign %s", strconv.QuoteRune(c))
+		}
+	}
+	return signs, nil
+}
@@ -0,0 +1,120 @@
+package schema
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	twoDecimals := Schema{Separator: ',', Scale: 2, Signs: SignMinus | SignPlus}
+	integers := Schema{Separator: '\t', Scale: 0, Signs: SignMinus}
+
+	tests := []struct {
+		schema Schema
+		in     string
+		want   int64
+		ok     bool
+	}{
+		{Default, "12.3", 123, true},
+		{Default, "-0.5", -5, true},
+		{Default, "7", 70, true},
+		{Default, "+1.0", 0, false},
+		{Default, "1.23", 0, false},
+		{Default, "1.", 0, false},
+		{Default, "-", 0, false},
+		{Default, "", 0, false},
+		{Default, "1.2.3", 0, false},
+		{twoDecimals, "+12.34", 1234, true},
+		{twoDecimals, "-1.5", -150, true},
+		{twoDecimals, "3", 300, true},
+		{twoDecimals, "1.234", 0, false},
+		{integers, "-42", -42, true},
+		{integers, "4.2", 0, false},
+		{integers, "123456789012345678", 123456789012345678, true},
+		{integers, "1234567890123456789", 0, false},
+		{Schema{Separator: ';', Scale: 9}, "1234567890.5", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := tt.schema.ParseValue([]byte(tt.in))
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("%+v ParseValue(%q) = %v, %v, expected %v", tt.schema, tt.in, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%+v ParseValue(%q) = %v, expected an error", tt.schema, tt.in, got)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	rfc := Schema{Separator: ';', Scale: 1, Time: TimeRFC3339}
+	unix := Schema{Separator: ';', Scale: 1, Time: TimeUnix}
+
+	for _, in := range []string{"2026-10-19T12:00:00Z", "2026-10-19T14:00:00+02:00"} {
+		if sec, err := rfc.ParseTime([]byte(in)); err != nil || sec != 1792411200 {
+			t.Errorf("ParseTime(%q) = %v, %v, expected 1792411200", in, sec, err)
+		}
+	}
+	if sec, err := unix.ParseTime([]byte("1792411200")); err != nil || sec != 1792411200 {
+		t.Errorf("ParseTime(1792411200) = %v, %v", sec, err)
+	}
+	for _, in := range []string{"", "2026-10-19", "12:00"} {
+		if _, err := rfc.ParseTime([]byte(in)); err == nil {
+			t.Errorf("expected an error for %q", in)
+		}
+	}
+	if _, err := Default.ParseTime([]byte("1792411200")); err == nil {
+		t.Error("expected an error without a timestamp column")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []Schema{
+		{Separator: '\n', Scale: 1}, {Separator: '.', Scale: 1}, {Separator: '5', Scale: 1}, {Separator: ';', Scale: -1},
+		{Separator: ';', Scale: MaxScale + 1}, {Separator: '"', Scale: 1}, {Separator: 0xC3, Scale: 1},
+		{Separator: 'T', Scale: 1, Time: TimeRFC3339}, {Separator: 'Z', Scale: 1, Time: TimeRFC3339},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", s)
+		}
+	}
+	for _, columns := range [][]string{{"temp", ""}, {"temp", "humidity", "temp"}} {
+		if err := (Schema{Separator: ';', Scale: 1, Columns: columns}).Validate(); err == nil {
+			t.Errorf("expected columns %q to be invalid", columns)
+		}
+	}
+	// T and Z are only ambiguous next to RFC 3339 timestamps
+	if err := (Schema{Separator: 'T', Scale: 1, Time: TimeUnix}).Validate(); err != nil {
+		t.Errorf("T with unix timestamps is invalid: %v", err)
+	}
+	if err := Default.Validate(); err != nil {
+		t.Errorf("default schema is invalid: %v", err)
+	}
+}
+
+func FuzzParseValue(f *testing.F) {
+	for _, seed := range []string{"12.3", "-0.5", "+1", "1.", ".5", "", "-"} {
+		f.Add(seed, uint8(1))
+	}
+	f.Fuzz(func(t *testing.T, in string, scale uint8) {
+		s := Schema{Separator: ';', Scale: int(scale % (MaxScale + 1)), Signs: SignMinus | SignPlus}
+		v, err := s.ParseValue([]byte(in))
+		if err != nil {
+			return
+		}
+		// Whatever is accepted must survive a round trip through its canonical form
+		if back, err := s.ParseValue([]byte(format(v, s.Scale))); err != nil || back != v {
+			t.Errorf("ParseValue(%q) = %v, round trip gives %v, %v", in, v, back, err)
+		}
+	})
+}
+
+func format(v int64, scale int) string {
+	if scale == 0 {
+		return fmt.Sprint(v)
+	}
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, v/pow10[scale], scale, v%pow10[scale])
+}
@@ -0,0 +1,103 @@
+package writeresult
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// StationDiff is a station whose statistics differ by more than the tolerance in at least one field.
+type StationDiff struct {
+	Name     string
+	Expected Stats
+	Actual   Stats
+	Fields   []string // "min", "mean" or "max", in this order
+}
+
+// DiffReport is the comparison of two results, stations are sorted by name.
+type DiffReport struct {
+	Compared int      // stations in both results
+	Missing  []string // only in the expected result
+	Extra    []string // only in the actual result
+	Changed  []StationDiff
+}
+
+// Diff compares two results field by field, values differing by no more than tolerance are equal.
+func Diff(expected, actual map[string]Stats, tolerance float64) *DiffReport {
+	// Values are decimal, don't let a difference of 0.1 between 23.5 and 23.6 count as 0.10000000000000142
+	tolerance += 1e-9
+
+	r := &DiffReport{}
+	for name, e := range expected {
+		a, ok := actual[name]
+		if !ok {
+			r.Missing = append(r.Missing, name)
+			continue
+		}
+		r.Compared++
+
+		d := StationDiff{Name: name, Expected: e, Actual: a}
+		for _, f := range []struct {
+			name string
+			e, a float64
+		}{{"min", e.Min, a.Min}, {"mean", e.Mean, a.Mean}, {"max", e.Max, a.Max}} {
+			if math.Abs(f.e-f.a) > tolerance {
+				d.Fields = append(d.Fields, f.name)
+			}
+		}
+		if len(d.Fields) > 0 {
+			r.Changed = append(r.Changed, d)
+		}
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			r.Extra = append(r.Extra, name)
+		}
+	}
+
+	sort.Strings(r.Missing)
+	sort.Strings(r.Extra)
+	sort.Slice(r.Changed, func(i, j int) bool { return r.Changed[i].Name < r.Changed[j].Name })
+	return r
+}
+
+// Equal reports whether the results have the same stations with the same statistics.
+func (r *DiffReport) Equal() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Changed) == 0
+}
+
+// String is a summary line followed by one line per difference.
+func (r *DiffReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d stations compared: %d missing, %d extra, %d different\n", r.Compared, len(r.Missing), len(r.Extra), len(r.Changed))
+	for _, name := range r.Missing {
+		fmt.Fprintf(&sb, "missing %q\n", name)
+	}
+	for _, name := range r.Extra {
+		fmt.Fprintf(&sb, "extra %q\n", name)
+	}
+	for _, d := range r.Changed {
+		fmt.Fprintf(&sb, "%q: expected %s, got %s (%s)\n", d.Name, d.Expected, d.Actual, strings.Join(d.Fields, ", "))
+	}
+	return sb.String()
+}
+
+// DiffOutputs describes how two outputs written by ToWriter differ, for tests. Outputs that can't be parsed are
+// printed whole.
+func DiffOutputs(expected, actual string) string {
+	e, err := Parse(expected)
+	if err != nil {
+		return fmt.Sprintf("cannot parse expected output: %v\nExpected:\n%s\nActual:\n%s", err, expected, actual)
+	}
+	a, err := Parse(actual)
+	if err != nil {
+		return fmt.Sprintf("cannot parse actual output: %v\nExpected:\n%s\nActual:\n%s", err, expected, actual)
+	}
+	r := Diff(e, a, 0)
+	if r.Equal() {
+		// Same statistics written differently, such as with another number of decimals
+		return fmt.Sprintf("same statistics written differently\nExpected:\n%s\nActual:\n%s", expected, actual)
+	}
+	return r.String()
+}
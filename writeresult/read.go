@@ -0,0 +1,152 @@
+package writeresult
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Stats are the statistics of a station in a result, "min/mean/max".
+type Stats struct {
+	Min  float64
+	Mean float64
+	Max  float64
+	// Decimals is the number of fractional digits the values are written with.
+	Decimals int
+}
+
+func (s Stats) String() string {
+	d := s.Decimals
+	return fmt.Sprintf("%.*f/%.*f/%.*f", d, s.Min, d, s.Mean, d, s.Max)
+}
+
+// ParseStats parses "min/mean/max", the values must all have the same number of fractional digits so they're
+// written back the same way (as long as they have no more than 15 significant digits, like any float64).
+func ParseStats(s string) (Stats, error) {
+	fields := strings.Split(s, "/")
+	if len(fields) != 3 {
+		return Stats{}, fmt.Errorf("expected min/mean/max, got %q", s)
+	}
+	var values [3]float64
+	decimals := -1
+	for i, f := range fields {
+		d, ok := decimalsOf(f)
+		if !ok {
+			return Stats{}, fmt.Errorf("invalid value %q in %q", f, s)
+		}
+		if decimals >= 0 && d != decimals {
+			return Stats{}, fmt.Errorf("values of %q have different numbers of decimals", s)
+		}
+		decimals = d
+		values[i], _ = strconv.ParseFloat(f, 64)
+	}
+	return Stats{Min: values[0], Mean: values[1], Max: values[2], Decimals: decimals}, nil
+}
+
+// decimalsOf returns the number of fractional digits of a value written with %.*f: an optional minus sign, digits
+// without leading zeros, and a dot followed by digits.
+func decimalsOf(v string) (int, bool) {
+	v = strings.TrimPrefix(v, "-")
+	whole, frac, hasDot := strings.Cut(v, ".")
+	if !isDigits(whole) || len(whole) > 1 && whole[0] == '0' || hasDot && !isDigits(frac) {
+		return 0, false
+	}
+	return len(frac), true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse parses a result written by ToWriter: "{Abha=-1.0/2.0/3.0, Washington, D.C.=...}".
+// Names may contain ", " and "=", so an entry only ends at the first ", " after "=min/mean/max".
+func Parse(s string) (map[string]Stats, error) {
+	s = strings.TrimSuffix(s, "\n")
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("expected a result between braces")
+	}
+	s = s[1 : len(s)-1]
+
+	res := make(map[string]Stats)
+	for pos := 1; s != ""; {
+		name, stats, n, err := parseEntry(s)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: %w", pos, err)
+		}
+		if _, ok := res[name]; ok {
+			return nil, fmt.Errorf("at %d: duplicate station %q", pos, name)
+		}
+		res[name] = stats
+
+		if n == len(s) {
+			break
+		}
+		if n+2 == len(s) {
+			return nil, fmt.Errorf("at %d: missing entry after \", \"", pos+n)
+		}
+		s = s[n+2:]
+		pos += n + 2
+	}
+	return res, nil
+}
+
+// parseEntry parses the first entry of s, n is its length without the ", " after it.
+func parseEntry(s string) (name string, stats Stats, n int, err error) {
+	for i := 0; ; {
+		j := strings.Index(s[i:], ", ")
+		n = len(s)
+		if j >= 0 {
+			n = i + j
+		}
+
+		entry := s[:n]
+		if eq := strings.LastIndexByte(entry, '='); eq > 0 {
+			if stats, err := ParseStats(entry[eq+1:]); err == nil {
+				return entry[:eq], stats, n, nil
+			}
+		}
+		if j < 0 {
+			return "", Stats{}, 0, fmt.Errorf("expected name=min/mean/max, got %q", s)
+		}
+		i = n + 2
+	}
+}
+
+// Read parses the result r holds, see Parse.
+func Read(r io.Reader) (map[string]Stats, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(data))
+}
+
+// ReadFile parses the result in filename, see Parse.
+func ReadFile(filename string) (map[string]Stats, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Read(file)
+}
+
+// Format turns parsed results back into what ToWriter takes, so they're written the way they were read.
+func Format(res map[string]Stats) map[string]string {
+	out := make(map[string]string, len(res))
+	for name, s := range res {
+		out[name] = s.String()
+	}
+	return out
+}
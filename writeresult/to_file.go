@@ -2,6 +2,7 @@ package writeresult
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sort"
 )
@@ -13,13 +14,17 @@ func ToFile(filename string, res map[string]string) error {
 	}
 	defer file.Close()
 
+	return ToWriter(file, res)
+}
+
+func ToWriter(w io.Writer, res map[string]string) error {
 	keys := make([]string, 0, len(res))
 	for k := range res {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
 
-	_, err = file.WriteString("{")
+	_, err := io.WriteString(w, "{")
 	if err != nil {
 		return err
 	}
@@ -30,11 +35,71 @@ func ToFile(filename string, res map[string]string) error {
 		if i != 0 {
 			entry = ", " + entry
 		}
-		if _, err := file.WriteString(entry); err != nil {
+		if _, err := io.WriteString(w, entry); err != nil {
 			return err
 		}
 	}
 
-	_, err = file.WriteString("}\n")
+	_, err = io.WriteString(w, "}\n")
 	return err
 }
+
+// MetricsToFile writes the result of every metric, see MetricsToWriter.
+func MetricsToFile(filename string, names []string, res []map[string]string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return MetricsToWriter(file, names, res)
+}
+
+// MetricsToWriter writes one line per metric, the name of the metric followed by its result the way ToWriter
+// writes it: "temp: {Abha=...}".
+func MetricsToWriter(w io.Writer, names []string, res []map[string]string) error {
+	for i, name := range names {
+		if _, err := io.WriteString(w, name+": "); err != nil {
+			return err
+		}
+		if err := ToWriter(w, res[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Window is the result of a station during one time window.
+type Window struct {
+	Label  string
+	Result string
+}
+
+// WindowsToWriter writes one line per station with its windows in the given order:
+// "Abha={2026-10-19=-1.0/2.0/3.0, 2026-10-20=...}".
+func WindowsToWriter(w io.Writer, res map[string][]Window) error {
+	keys := make([]string, 0, len(res))
+	for k := range res {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if _, err := io.WriteString(w, k+"={"); err != nil {
+			return err
+		}
+		for i, win := range res[k] {
+			entry := fmt.Sprintf("%s=%s", win.Label, win.Result)
+			if i != 0 {
+				entry = ", " + entry
+			}
+			if _, err := io.WriteString(w, entry); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, "}\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package writeresult
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	expected, err := os.ReadFile("../output_small.txt")
+	if err != nil {
+		t.Fatalf("failed to read expected output: %v", err)
+	}
+
+	res, err := Parse(string(expected))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if s := res["Washington, D.C."]; s != (Stats{Min: 3.8, Mean: 11.8, Max: 23.5, Decimals: 1}) {
+		t.Errorf("Washington, D.C. is %+v", s)
+	}
+	if _, ok := res["Flores,  Petén"]; !ok {
+		t.Errorf("Flores,  Petén is missing")
+	}
+
+	// Written back it's the same file
+	var b bytes.Buffer
+	if err := ToWriter(&b, Format(res)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if b.String() != string(expected) {
+		t.Errorf("round trip changed the output:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+
+	tests := []struct {
+		in   string
+		want map[string]Stats // nil for an error
+	}{
+		{"{}", map[string]Stats{}},
+		{"{A=B=-0.0/1.5/3.0, C, D=1/2/3}\n", map[string]Stats{"A=B": {Min: 0, Mean: 1.5, Max: 3, Decimals: 1}, "C, D": {Min: 1, Mean: 2, Max: 3}}},
+		{"{A, =1.00/2.00/3.00}", map[string]Stats{"A, ": {Min: 1, Mean: 2, Max: 3, Decimals: 2}}},
+		{"A=1.0/2.0/3.0", nil},
+		{"{A=1.0/2.0}", nil},
+		{"{=1.0/2.0/3.0}", nil},
+		{"{A=1.0/2.0/3.0, }", nil},
+		{"{A=1.0/2.0/3.0, A=1.0/2.0/3.0}", nil},
+		{"{A=1.0/2.00/3.0}", nil},
+		{"{A=01.0/2.0/3.0}", nil},
+		{"{A=1e3/2.0/3.0}", nil},
+		{"{A=+1.0/2.0/3.0}", nil},
+		{"{A=1./2.0/3.0}", nil},
+	}
+	for _, tt := range tests {
+		res, err := Parse(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("Parse(%q) = %v, expected an error", tt.in, res)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, tt.want) {
+			t.Errorf("Parse(%q) = %v, expected %v", tt.in, res, tt.want)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add("Washington, D.C.", "Abha", 3.8, 11.8, 23.5)
+	f.Add("A=B", "A, =", -99.9, 0.0, 99.9)
+	f.Fuzz(func(t *testing.T, name1, name2 string, lo, mean, hi float64) {
+		for _, v := range []float64{lo, mean, hi} {
+			if !(v > -1e9 && v < 1e9) {
+				return
+			}
+		}
+		if name1 == "" || name2 == "" || strings.ContainsAny(name1+name2, "\n") {
+			return
+		}
+
+		in := map[string]string{
+			name1: Stats{Min: lo, Mean: mean, Max: hi, Decimals: 1}.String(),
+			name2: Stats{Min: hi, Mean: lo, Max: mean, Decimals: 1}.String(),
+		}
+		var b bytes.Buffer
+		if err := ToWriter(&b, in); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		res, err := Parse(b.String())
+		if err != nil {
+			// Names that end like an entry can't be told apart from two entries
+			if looksLikeEntry(name1) || looksLikeEntry(name2) {
+				return
+			}
+			t.Fatalf("Parse(%q) failed: %v", b.String(), err)
+		}
+		if out := Format(res); !reflect.DeepEqual(out, in) && !looksLikeEntry(name1) && !looksLikeEntry(name2) {
+			t.Errorf("Parse(%q) = %v, expected %v", b.String(), out, in)
+		}
+	})
+}
+
+// looksLikeEntry reports whether a name contains what could be the end of an entry, "=min/mean/max, ".
+func looksLikeEntry(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if j := strings.Index(name[i:], ", "); j >= 0 {
+			if _, _, _, err := parseEntry(name[:i+j]); err == nil {
+				return true
+			}
+			i += j
+			continue
+		}
+		break
+	}
+	return false
+}
+
+func TestDiff(t *testing.T) {
+	expected := map[string]Stats{
+		"Abha":             {Min: 7.9, Mean: 17.2, Max: 24.3, Decimals: 1},
+		"Aden":             {Min: 19.2, Mean: 30.2, Max: 41.8, Decimals: 1},
+		"Washington, D.C.": {Min: 3.8, Mean: 11.8, Max: 23.5, Decimals: 1},
+	}
+	actual := map[string]Stats{
+		"Abha":             {Min: 7.9, Mean: 17.3, Max: 24.3, Decimals: 1},
+		"Washington, D.C.": {Min: 3.6, Mean: 11.8, Max: 23.6, Decimals: 1},
+		"Zagreb":           {Min: 1, Mean: 2, Max: 3, Decimals: 1},
+	}
+
+	r := Diff(expected, actual, 0.1)
+	if r.Compared != 2 || !reflect.DeepEqual(r.Missing, []string{"Aden"}) || !reflect.DeepEqual(r.Extra, []string{"Zagreb"}) {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if len(r.Changed) != 1 || r.Changed[0].Name != "Washington, D.C." || !reflect.DeepEqual(r.Changed[0].Fields, []string{"min"}) {
+		t.Errorf("got changes %+v, expected the min of Washington, D.C.", r.Changed)
+	}
+	if r.Equal() {
+		t.Errorf("results with differences are equal")
+	}
+	want := "2 stations compared: 1 missing, 1 extra, 1 different\n" +
+		"missing \"Aden\"\n" +
+		"extra \"Zagreb\"\n" +
+		"\"Washington, D.C.\": expected 3.8/11.8/23.5, got 3.6/11.8/23.6 (min)\n"
+	if r.String() != want {
+		t.Errorf("got\n%s\nexpected\n%s", r, want)
+	}
+
+	if r := Diff(expected, expected, 0); !r.Equal() || r.Compared != 3 {
+		t.Errorf("a result differs from itself: %+v", r)
+	}
+	if r := Diff(expected, actual, 0); len(r.Changed) != 2 {
+		t.Errorf("got %d changes without tolerance, expected 2", len(r.Changed))
+	}
+}